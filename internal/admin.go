@@ -0,0 +1,354 @@
+package internal
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AdminServer exposes pools and their leases over HTTP/JSON:
+//
+//	GET    /pools                          list pools with utilization
+//	GET    /pools/{name}                   single pool
+//	GET    /pools/{name}/leases            leases of pool
+//	POST   /pools/{name}/leases            create reservation
+//	DELETE /pools/{name}/leases/{address}  force lease release
+//
+// Pool state is only touched from within pool's Run goroutine, see Pool.Do.
+type AdminServer struct {
+	Pools *PoolSet
+}
+
+type adminPool struct {
+	Name        string  `json:"name"`
+	Network     string  `json:"network"`
+	Start       string  `json:"start"`
+	End         string  `json:"end"`
+	Size        int     `json:"size"`
+	Hosts       int     `json:"hosts"`
+	InUse       int     `json:"in_use"`
+	Reserved    int     `json:"reserved"`
+	Declined    int     `json:"declined"`
+	Static      int     `json:"static"`
+	Expired     int     `json:"expired"`
+	Utilization float64 `json:"utilization"`
+}
+
+type adminLease struct {
+	Address  string     `json:"address"`
+	State    string     `json:"state"`
+	ClientID string     `json:"client_id,omitempty"`
+	Mac      string     `json:"mac,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+}
+
+type adminReservation struct {
+	Address  string `json:"address"`
+	ClientID string `json:"client_id"`
+	Mac      string `json:"mac"`
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+func ServeAdmin(listen string, pools *PoolSet) error {
+	return http.ListenAndServe(listen, &AdminServer{Pools: pools})
+}
+
+func (admin *AdminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	if parts[0] != "pools" || len(parts) > 4 {
+		writeAdminError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	if len(parts) == 1 {
+		admin.handlePools(w, r)
+		return
+	}
+
+	pool := admin.Pools.Find(parts[1])
+
+	if pool == nil {
+		writeAdminError(w, http.StatusNotFound, "Unknown pool")
+		return
+	}
+
+	switch {
+	case len(parts) == 2:
+		admin.handlePool(w, r, pool)
+
+	case parts[2] != "leases":
+		writeAdminError(w, http.StatusNotFound, "Not found")
+
+	case len(parts) == 3:
+		admin.handleLeases(w, r, pool)
+
+	default:
+		admin.handleLease(w, r, pool, parts[3])
+	}
+}
+
+func (admin *AdminServer) handlePools(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	pools := admin.Pools.Pools()
+	result := make([]adminPool, 0, len(pools))
+
+	for _, pool := range pools {
+		var summary adminPool
+
+		// pool removed by reload meanwhile
+		if pool.Do(func() { summary = pool.summary() }) {
+			result = append(result, summary)
+		}
+	}
+
+	writeAdminJSON(w, http.StatusOK, result)
+}
+
+func (admin *AdminServer) handlePool(w http.ResponseWriter, r *http.Request, pool *Pool) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var summary adminPool
+
+	if !pool.Do(func() { summary = pool.summary() }) {
+		writeAdminError(w, http.StatusNotFound, "Unknown pool")
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, summary)
+}
+
+func (admin *AdminServer) handleLeases(w http.ResponseWriter, r *http.Request, pool *Pool) {
+	switch r.Method {
+	case http.MethodGet:
+		var result []adminLease
+
+		if !pool.Do(func() { result = pool.leaseList() }) {
+			writeAdminError(w, http.StatusNotFound, "Unknown pool")
+			return
+		}
+
+		writeAdminJSON(w, http.StatusOK, result)
+
+	case http.MethodPost:
+		var req adminReservation
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAdminError(w, http.StatusBadRequest, "Invalid JSON body")
+			return
+		}
+
+		lease, err := newReservation(&req)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		var invalid error
+
+		ran := pool.Do(func() {
+			if _, invalid = pool.reservableIndex(lease.Address); invalid == nil {
+				err = pool.reserve(lease)
+			}
+		})
+
+		if !ran {
+			writeAdminError(w, http.StatusNotFound, "Unknown pool")
+			return
+		}
+
+		if invalid != nil {
+			writeAdminError(w, http.StatusBadRequest, invalid.Error())
+			return
+		}
+
+		if err != nil {
+			writeAdminError(w, http.StatusConflict, err.Error())
+			return
+		}
+
+		writeAdminJSON(w, http.StatusCreated, newAdminLease(lease))
+
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func (admin *AdminServer) handleLease(w http.ResponseWriter, r *http.Request, pool *Pool, address string) {
+	if r.Method != http.MethodDelete {
+		writeAdminError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	ip := net.ParseIP(address).To4()
+	if ip == nil {
+		writeAdminError(w, http.StatusBadRequest, "Invalid IPv4 address")
+		return
+	}
+
+	released := false
+
+	if !pool.Do(func() { released = pool.release(ip) }) {
+		writeAdminError(w, http.StatusNotFound, "Unknown pool")
+		return
+	}
+
+	if !released {
+		writeAdminError(w, http.StatusNotFound, "No lease for address")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func newReservation(req *adminReservation) (*Lease, error) {
+	lease := &Lease{
+		State: LeaseStatic,
+	}
+
+	if lease.Address = net.ParseIP(req.Address).To4(); lease.Address == nil {
+		return nil, errors.New("Invalid IPv4 address")
+	}
+
+	if req.Mac == "" && req.ClientID == "" {
+		return nil, errors.New("One of mac or client_id is required")
+	}
+
+	if req.Mac != "" {
+		mac, err := net.ParseMAC(req.Mac)
+		if err != nil {
+			return nil, err
+		}
+
+		lease.ID.Mac = mac
+	}
+
+	if req.ClientID != "" {
+		id, err := parseHexBytes(req.ClientID)
+		if err != nil {
+			return nil, err
+		}
+
+		lease.ID.ID = id
+	}
+
+	return lease, nil
+}
+
+func newAdminLease(lease *Lease) adminLease {
+	result := adminLease{
+		Address: lease.Address.String(),
+		State:   lease.State.String(),
+	}
+
+	if len(lease.ID.ID) > 0 {
+		result.ClientID = hex.EncodeToString(lease.ID.ID)
+	}
+
+	if len(lease.ID.Mac) > 0 {
+		result.Mac = lease.ID.Mac.String()
+	}
+
+	if lease.State != LeaseStatic {
+		expires := lease.Expires
+		result.Expires = &expires
+	}
+
+	return result
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		Log.Warn("Unable to write admin response", "error", err)
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, status int, message string) {
+	writeAdminJSON(w, status, adminError{Error: message})
+}
+
+// summary must be called from pool's Run goroutine
+func (pool *Pool) summary() adminPool {
+	result := adminPool{
+		Name:    pool.Name,
+		Network: pool.Network.String(),
+		Start:   pool.addressFromIndex(pool.Start).String(),
+		End:     pool.addressFromIndex(pool.End).String(),
+		Size:    int(pool.End - pool.Start + 1),
+	}
+
+	// reservations within range aren't available for dynamic allocation
+	for idx := range pool.Hosts {
+		if idx >= pool.Start && idx <= pool.End {
+			result.Hosts++
+		}
+	}
+
+	result.Size -= result.Hosts
+
+	used := 0
+
+	for idx, lease := range pool.Leases {
+		switch lease.State {
+		case LeaseInUse:
+			result.InUse++
+		case LeaseReserved:
+			result.Reserved++
+		case LeaseDeclined:
+			result.Declined++
+		case LeaseStatic:
+			result.Static++
+		case LeaseExpired:
+			// remembered only, address is free
+			result.Expired++
+			continue
+		}
+
+		if _, static := pool.Hosts[idx]; !static && idx >= pool.Start && idx <= pool.End {
+			used++
+		}
+	}
+
+	if result.Size > 0 {
+		result.Utilization = float64(used) / float64(result.Size)
+	}
+
+	return result
+}
+
+// leaseList must be called from pool's Run goroutine
+func (pool *Pool) leaseList() []adminLease {
+	indices := make([]int, 0, len(pool.Leases))
+
+	for idx := range pool.Leases {
+		indices = append(indices, int(idx))
+	}
+
+	sort.Ints(indices)
+
+	result := make([]adminLease, 0, len(indices))
+
+	for _, idx := range indices {
+		result = append(result, newAdminLease(pool.Leases[uint32(idx)]))
+	}
+
+	return result
+}
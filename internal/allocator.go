@@ -0,0 +1,373 @@
+package internal
+
+import (
+	"container/list"
+	"math/bits"
+	"math/rand"
+	"sort"
+)
+
+// longest client key: tag, client identifier length and value, hardware address
+const clientKeyBufferSize = 2 + 255 + 16
+
+// freeTree is Fenwick tree counting free indices of dynamic range, so that
+// counting and picking n-th free index take O(log n) without allocations
+type freeTree struct {
+	start uint32
+	size  int
+	// 1-based Fenwick sums of free flags
+	tree []int32
+	free []uint64
+}
+
+// newFreeTree creates tree with every index of start..end free or used
+func newFreeTree(start uint32, end uint32, free bool) *freeTree {
+	size := 0
+	if start <= end {
+		size = int(end-start) + 1
+	}
+
+	tree := &freeTree{
+		start: start,
+		size:  size,
+		tree:  make([]int32, size+1),
+		free:  make([]uint64, (size+63)/64),
+	}
+
+	if !free {
+		return tree
+	}
+
+	// all free: every node sums range as long as its lowest set bit
+	for i := 1; i <= size; i++ {
+		tree.tree[i] = int32(i & -i)
+	}
+
+	for i := 0; i < size; i++ {
+		tree.free[i/64] |= 1 << uint(i%64)
+	}
+
+	return tree
+}
+
+func (tree *freeTree) contains(idx uint32) bool {
+	return idx >= tree.start && int(idx-tree.start) < tree.size
+}
+
+func (tree *freeTree) isFree(idx uint32) bool {
+	if !tree.contains(idx) {
+		return false
+	}
+
+	i := idx - tree.start
+
+	return tree.free[i/64]&(1<<(i%64)) != 0
+}
+
+// set marks index free or used, indices outside of range are ignored
+func (tree *freeTree) set(idx uint32, free bool) {
+	if !tree.contains(idx) || tree.isFree(idx) == free {
+		return
+	}
+
+	i := idx - tree.start
+	delta := int32(-1)
+
+	if free {
+		tree.free[i/64] |= 1 << (i % 64)
+		delta = 1
+	} else {
+		tree.free[i/64] &^= 1 << (i % 64)
+	}
+
+	for j := int(i) + 1; j <= tree.size; j += j & -j {
+		tree.tree[j] += delta
+	}
+}
+
+// countBefore returns number of free indices lower than idx
+func (tree *freeTree) countBefore(idx uint32) int {
+	if idx <= tree.start {
+		return 0
+	}
+
+	n := int(idx - tree.start)
+	if n > tree.size {
+		n = tree.size
+	}
+
+	count := 0
+
+	for j := n; j > 0; j -= j & -j {
+		count += int(tree.tree[j])
+	}
+
+	return count
+}
+
+// count returns number of free indices within lo..hi
+func (tree *freeTree) count(lo uint32, hi uint32) int {
+	if lo > hi {
+		return 0
+	}
+
+	return tree.countBefore(hi+1) - tree.countBefore(lo)
+}
+
+// nth returns index of n-th free index, counted from 0
+func (tree *freeTree) nth(n int) uint32 {
+	pos := 0
+	remaining := int32(n)
+
+	for step := 1 << uint(bits.Len(uint(tree.size))-1); step > 0; step >>= 1 {
+		if next := pos + step; next <= tree.size && tree.tree[next] <= remaining {
+			pos = next
+			remaining -= tree.tree[next]
+		}
+	}
+
+	return tree.start + uint32(pos)
+}
+
+// pick selects free index within lo..hi according to algorithm, preferred
+// is used by Hashed only
+func (tree *freeTree) pick(algo AddressSelectAlgorithm, lo uint32, hi uint32, preferred uint32) (uint32, bool) {
+	count := tree.count(lo, hi)
+
+	if count == 0 {
+		return 0, false
+	}
+
+	first := tree.countBefore(lo)
+
+	switch algo {
+	case Randomized:
+		return tree.nth(first + rand.Intn(count)), true
+
+	case Hashed:
+		// first free at or after preferred, wrapping around to lo
+		if preferred > lo && preferred <= hi {
+			if n := tree.countBefore(preferred); n < first+count {
+				return tree.nth(n), true
+			}
+		}
+	}
+
+	return tree.nth(first), true
+}
+
+// hashIndex maps key to index within start..end using FNV-1a
+func hashIndex(key []byte, start uint32, end uint32) uint32 {
+	hash := uint32(2166136261)
+
+	for _, b := range key {
+		hash ^= uint32(b)
+		hash *= 16777619
+	}
+
+	return start + uint32(uint64(hash)%(uint64(end-start)+1))
+}
+
+// allocator indexes leases of pool, kept up to date by Pool.setLease
+type allocator struct {
+	free *freeTree
+	// expired leases allocate may recycle, hosts' addresses excluded
+	recyclable *freeTree
+	// indices of leases by client key
+	clients map[string][]uint32
+	keys    map[uint32]string
+	// indices of expired leases, least recently used first
+	expired  *list.List
+	elements map[uint32]*list.Element
+}
+
+// rebuildAllocator indexes leases after range, hosts or identity policy changed
+func (pool *Pool) rebuildAllocator() {
+	pool.alloc = &allocator{
+		free:       newFreeTree(pool.Start, pool.End, true),
+		recyclable: newFreeTree(pool.Start, pool.End, false),
+		clients:    make(map[string][]uint32),
+		keys:       make(map[uint32]string),
+		expired:    list.New(),
+		elements:   make(map[uint32]*list.Element),
+	}
+
+	for idx := range pool.Hosts {
+		pool.alloc.free.set(idx, false)
+	}
+
+	var expired []uint32
+
+	for idx, lease := range pool.Leases {
+		pool.index(idx, lease)
+
+		if lease.State == LeaseExpired {
+			expired = append(expired, idx)
+		}
+	}
+
+	// sorted once, inserting one by one would scan the list for each lease
+	sort.Slice(expired, func(i, j int) bool {
+		a, b := pool.Leases[expired[i]], pool.Leases[expired[j]]
+
+		if !a.Expires.Equal(b.Expires) {
+			return a.Expires.Before(b.Expires)
+		}
+
+		return expired[i] < expired[j]
+	})
+
+	for _, idx := range expired {
+		pool.alloc.elements[idx] = pool.alloc.expired.PushBack(idx)
+	}
+}
+
+// setLease changes lease at index without touching store, nil lease removes it
+func (pool *Pool) setLease(idx uint32, lease *Lease) {
+	if old, found := pool.Leases[idx]; found && (old != lease || lease.State != LeaseReserved) {
+		delete(pool.returning, old)
+	}
+
+	if lease == nil {
+		delete(pool.Leases, idx)
+	} else {
+		pool.Leases[idx] = lease
+	}
+
+	pool.index(idx, lease)
+
+	if lease != nil && lease.State == LeaseExpired {
+		pool.insertExpired(idx, lease)
+	}
+}
+
+// index updates indices of lease at idx except expired list
+func (pool *Pool) index(idx uint32, lease *Lease) {
+	alloc := pool.alloc
+
+	if key, found := alloc.keys[idx]; found {
+		indices := alloc.clients[key]
+
+		for i, other := range indices {
+			if other == idx {
+				indices = append(indices[:i], indices[i+1:]...)
+				break
+			}
+		}
+
+		if len(indices) == 0 {
+			delete(alloc.clients, key)
+		} else {
+			alloc.clients[key] = indices
+		}
+
+		delete(alloc.keys, idx)
+	}
+
+	if element, found := alloc.elements[idx]; found {
+		alloc.expired.Remove(element)
+		delete(alloc.elements, idx)
+	}
+
+	_, static := pool.Hosts[idx]
+
+	alloc.recyclable.set(idx, !static && lease != nil && lease.State == LeaseExpired)
+
+	if lease == nil {
+		alloc.free.set(idx, !static)
+		return
+	}
+
+	alloc.free.set(idx, false)
+
+	// declined addresses belong to nobody
+	if lease.State != LeaseDeclined {
+		var buffer [clientKeyBufferSize]byte
+
+		key := string(pool.clientKey(buffer[:0], &lease.ID))
+		alloc.keys[idx] = key
+		alloc.clients[key] = append(alloc.clients[key], idx)
+	}
+}
+
+// insertExpired puts expired lease on expired list ordered by expiry time
+func (pool *Pool) insertExpired(idx uint32, lease *Lease) {
+	alloc := pool.alloc
+
+	// usually expired just now, search from the most recent end
+	mark := alloc.expired.Back()
+
+	for mark != nil && pool.Leases[mark.Value.(uint32)].Expires.After(lease.Expires) {
+		mark = mark.Prev()
+	}
+
+	if mark == nil {
+		alloc.elements[idx] = alloc.expired.PushFront(idx)
+	} else {
+		alloc.elements[idx] = alloc.expired.InsertAfter(idx, mark)
+	}
+}
+
+// clientKey appends key equal for identifiers sameClient considers the same
+func (pool *Pool) clientKey(key []byte, id *ClientIdentifier) []byte {
+	switch pool.Identity {
+	case ClientIDMacOnly:
+		return append(append(key, 'm'), id.Mac...)
+
+	case ClientIDAndMac:
+		key = append(key, 'b', byte(len(id.ID)))
+		return append(append(key, id.ID...), id.Mac...)
+	}
+
+	if len(id.ID) > 0 {
+		return append(append(key, 'i'), id.ID...)
+	}
+
+	return append(append(key, 'm'), id.Mac...)
+}
+
+// clientIndices returns indices of client's leases, slice must not be modified
+func (pool *Pool) clientIndices(id *ClientIdentifier) []uint32 {
+	var buffer [clientKeyBufferSize]byte
+
+	return pool.alloc.clients[string(pool.clientKey(buffer[:0], id))]
+}
+
+// clientLeases returns copy of client's indices, safe to change leases while iterating
+func (pool *Pool) clientLeases(id *ClientIdentifier) []uint32 {
+	return append([]uint32(nil), pool.clientIndices(id)...)
+}
+
+// ownRange returns part of dynamic range this server allocates from
+func (pool *Pool) ownRange() (uint32, uint32) {
+	return pool.Peer.share(pool.Start, pool.End)
+}
+
+// pickFree selects never used or released address for client, false when there's none
+func (pool *Pool) pickFree(id *ClientIdentifier) (uint32, bool) {
+	var preferred uint32
+
+	lo, hi := pool.ownRange()
+
+	if pool.Algorithm == Hashed && lo <= hi {
+		var buffer [clientKeyBufferSize]byte
+
+		// whole range, so that failover partners prefer the same address
+		preferred = hashIndex(pool.clientKey(buffer[:0], id), pool.Start, pool.End)
+
+		// clients preferring partner's share get stable address in ours
+		if preferred < lo || preferred > hi {
+			preferred = lo + (preferred-pool.Start)%(hi-lo+1)
+		}
+	}
+
+	return pool.alloc.free.pick(pool.Algorithm, lo, hi, preferred)
+}
+
+// freeCount returns number of addresses allocate may hand out, including
+// recycled ones of expired leases
+func (pool *Pool) freeCount() int {
+	lo, hi := pool.ownRange()
+
+	return pool.alloc.free.count(lo, hi) + pool.alloc.recyclable.count(lo, hi)
+}
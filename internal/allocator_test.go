@@ -0,0 +1,517 @@
+package internal
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// handlers log every lease change, keep output readable
+	if err := SetupLogging(&LogConfig{Level: "error"}); err != nil {
+		panic(err)
+	}
+
+	os.Exit(m.Run())
+}
+
+func newTestPool(t testing.TB, conf PoolConfig) *Pool {
+	pool, err := NewPool("test", &conf, &MemoryLeaseStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pool
+}
+
+func testClient(n int) ClientIdentifier {
+	return ClientIdentifier{Mac: net.HardwareAddr{0x08, 0x00, 0x27, byte(n >> 16), byte(n >> 8), byte(n)}}
+}
+
+// checkAllocator compares allocator indices with pool's leases
+func checkAllocator(t *testing.T, pool *Pool) {
+	t.Helper()
+
+	alloc := pool.alloc
+
+	for idx := pool.Start; idx <= pool.End; idx++ {
+		lease, used := pool.Leases[idx]
+		_, static := pool.Hosts[idx]
+
+		if free := alloc.free.isFree(idx); free != (!used && !static) {
+			t.Errorf("Index %d free %v, leased %v, host %v", idx, free, used, static)
+		}
+
+		recyclable := used && !static && lease.State == LeaseExpired
+
+		if got := alloc.recyclable.isFree(idx); got != recyclable {
+			t.Errorf("Index %d recyclable %v, expected %v", idx, got, recyclable)
+		}
+	}
+
+	keys := 0
+
+	for idx, lease := range pool.Leases {
+		key, indexed := alloc.keys[idx]
+
+		if lease.State == LeaseDeclined {
+			if indexed {
+				t.Errorf("Declined index %d belongs to client", idx)
+			}
+			continue
+		}
+
+		keys++
+
+		if want := string(pool.clientKey(nil, &lease.ID)); key != want {
+			t.Errorf("Index %d has key %q, expected %q", idx, key, want)
+		}
+
+		found := false
+
+		for _, other := range pool.clientIndices(&lease.ID) {
+			found = found || other == idx
+		}
+
+		if !found {
+			t.Errorf("Index %d missing from client's indices", idx)
+		}
+	}
+
+	if len(alloc.keys) != keys {
+		t.Errorf("%d keys indexed, expected %d", len(alloc.keys), keys)
+	}
+
+	indexed := 0
+
+	for _, indices := range alloc.clients {
+		indexed += len(indices)
+	}
+
+	if indexed != keys {
+		t.Errorf("%d client indices, expected %d", indexed, keys)
+	}
+
+	expired := 0
+	var last time.Time
+
+	for e := alloc.expired.Front(); e != nil; e = e.Next() {
+		lease := pool.Leases[e.Value.(uint32)]
+
+		if lease == nil || lease.State != LeaseExpired {
+			t.Errorf("Index %d on expired list is not expired", e.Value.(uint32))
+			continue
+		}
+
+		if lease.Expires.Before(last) {
+			t.Errorf("Index %d out of order on expired list", e.Value.(uint32))
+		}
+
+		last = lease.Expires
+		expired++
+	}
+
+	for _, lease := range pool.Leases {
+		if lease.State == LeaseExpired {
+			expired--
+		}
+	}
+
+	if expired != 0 || alloc.expired.Len() != len(alloc.elements) {
+		t.Errorf("Expired list has %d entries, %d elements, leases differ by %d", alloc.expired.Len(), len(alloc.elements), expired)
+	}
+}
+
+// newTestTree returns tree of 10..19 with given indices used
+func newTestTree(used ...uint32) *freeTree {
+	tree := newFreeTree(10, 19, true)
+
+	for _, idx := range used {
+		tree.set(idx, false)
+	}
+
+	return tree
+}
+
+func TestFreeTreeCount(t *testing.T) {
+	tests := []struct {
+		name   string
+		used   []uint32
+		lo, hi uint32
+		count  int
+	}{
+		{"whole range", nil, 10, 19, 10},
+		{"first only", nil, 10, 10, 1},
+		{"last only", nil, 19, 19, 1},
+		{"empty range", nil, 15, 14, 0},
+		{"below start", nil, 0, 11, 2},
+		{"past end", nil, 18, 30, 2},
+		{"outside", nil, 20, 30, 0},
+		{"edges used", []uint32{10, 19}, 10, 19, 8},
+		{"all used", []uint32{10, 11, 12, 13, 14, 15, 16, 17, 18, 19}, 10, 19, 0},
+		{"used outside ignored", []uint32{9, 20}, 10, 19, 10},
+	}
+
+	for _, test := range tests {
+		tree := newTestTree(test.used...)
+
+		if count := tree.count(test.lo, test.hi); count != test.count {
+			t.Errorf("%s: count(%d, %d) = %d, expected %d", test.name, test.lo, test.hi, count, test.count)
+		}
+	}
+}
+
+func TestFreeTreeNth(t *testing.T) {
+	tests := []struct {
+		name string
+		used []uint32
+		n    int
+		idx  uint32
+	}{
+		{"first", nil, 0, 10},
+		{"last", nil, 9, 19},
+		{"skips used start", []uint32{10, 11}, 0, 12},
+		{"last before used end", []uint32{18, 19}, 7, 17},
+		{"single free at end", []uint32{10, 11, 12, 13, 14, 15, 16, 17, 18}, 0, 19},
+		{"between used", []uint32{12, 13, 14}, 2, 15},
+	}
+
+	for _, test := range tests {
+		tree := newTestTree(test.used...)
+
+		if idx := tree.nth(test.n); idx != test.idx {
+			t.Errorf("%s: nth(%d) = %d, expected %d", test.name, test.n, idx, test.idx)
+		}
+	}
+}
+
+func TestFreeTreePick(t *testing.T) {
+	tests := []struct {
+		name      string
+		algo      AddressSelectAlgorithm
+		used      []uint32
+		lo, hi    uint32
+		preferred uint32
+		idx       uint32
+		found     bool
+	}{
+		{"sequential", Sequential, nil, 10, 19, 0, 10, true},
+		{"sequential used start", Sequential, []uint32{10}, 10, 19, 0, 11, true},
+		{"sequential subrange", Sequential, nil, 15, 19, 0, 15, true},
+		{"sequential last", Sequential, []uint32{10, 11, 12, 13, 14, 15, 16, 17, 18}, 10, 19, 0, 19, true},
+		{"exhausted", Sequential, []uint32{10, 11, 12, 13, 14, 15, 16, 17, 18, 19}, 10, 19, 0, 0, false},
+		{"empty share", Sequential, nil, 16, 15, 0, 0, false},
+		{"random single", Randomized, []uint32{10, 11, 12, 13, 14, 16, 17, 18, 19}, 10, 19, 0, 15, true},
+		{"hashed preferred", Hashed, nil, 10, 19, 14, 14, true},
+		{"hashed at end", Hashed, nil, 10, 19, 19, 19, true},
+		{"hashed next free", Hashed, []uint32{14, 15}, 10, 19, 14, 16, true},
+		{"hashed wraps", Hashed, []uint32{18, 19}, 10, 19, 18, 10, true},
+		{"hashed wraps within share", Hashed, []uint32{19, 15}, 15, 19, 19, 16, true},
+		{"hashed outside share", Hashed, nil, 15, 19, 12, 15, true},
+	}
+
+	for _, test := range tests {
+		tree := newTestTree(test.used...)
+
+		idx, found := tree.pick(test.algo, test.lo, test.hi, test.preferred)
+
+		if found != test.found || idx != test.idx {
+			t.Errorf("%s: pick = %d, %v, expected %d, %v", test.name, idx, found, test.idx, test.found)
+		}
+	}
+}
+
+func TestFreeTreeRandomStaysInRange(t *testing.T) {
+	tree := newTestTree(12, 17)
+
+	for i := 0; i < 200; i++ {
+		idx, found := tree.pick(Randomized, 11, 18, 0)
+
+		if !found || idx < 11 || idx > 18 || !tree.isFree(idx) {
+			t.Fatalf("pick = %d, %v", idx, found)
+		}
+	}
+}
+
+func TestAllocatorIndexLifecycle(t *testing.T) {
+	pool := newTestPool(t, PoolConfig{
+		Network:  "10.0.0.0/24",
+		Start:    10,
+		End:      20,
+		Lifetime: "1h",
+		Hosts: map[string]HostConfig{
+			"printer": {Mac: "08:00:27:ff:ff:ff", Address: "10.0.0.15"},
+		},
+	})
+
+	checkAllocator(t, pool)
+
+	a, b, c := testClient(1), testClient(2), testClient(3)
+	log := pool.Logger
+
+	// reserve
+	leaseA := pool.allocate(&a, log)
+	leaseB := pool.allocate(&b, log)
+
+	if leaseA == nil || leaseB == nil {
+		t.Fatal("Allocation failed")
+	}
+
+	checkAllocator(t, pool)
+
+	if found, _ := pool.findClientLease(&a); found != leaseA {
+		t.Errorf("Client lease not found")
+	}
+
+	// acknowledge
+	idxA, _ := pool.leaseIndex(leaseA)
+	leaseA.State = LeaseInUse
+	pool.putLease(idxA, leaseA)
+	checkAllocator(t, pool)
+
+	// expire
+	leaseA.Expires = time.Now().Add(-time.Second)
+	leaseB.Expires = time.Now().Add(-time.Second)
+	pool.expireOld()
+	checkAllocator(t, pool)
+
+	if leaseA.State != LeaseExpired || pool.alloc.expired.Len() != 1 {
+		t.Errorf("Expired lease not remembered")
+	}
+
+	if _, found := pool.findClientLease(&b); found {
+		t.Errorf("Offer not reclaimed")
+	}
+
+	// returning client is found by its remembered binding
+	if found, _ := pool.findClientLease(&a); found != leaseA {
+		t.Errorf("Remembered lease not found")
+	}
+
+	// decline
+	leaseC := pool.allocate(&c, log)
+	idxC, _ := pool.leaseIndex(leaseC)
+	pool.freeLeases(&c)
+	pool.putLease(idxC, &Lease{Address: leaseC.Address, State: LeaseDeclined, Expires: time.Now().Add(time.Hour)})
+	checkAllocator(t, pool)
+
+	if _, found := pool.findClientLease(&c); found {
+		t.Errorf("Declined address still belongs to client")
+	}
+
+	// release
+	leaseB = pool.allocate(&b, log)
+	idxB, _ := pool.leaseIndex(leaseB)
+	leaseB.State = LeaseInUse
+	pool.putLease(idxB, leaseB)
+	pool.retire(idxB, leaseB)
+	checkAllocator(t, pool)
+
+	if front := pool.alloc.expired.Front().Value.(uint32); front != idxA {
+		t.Errorf("Least recently used index %d, expected %d", front, idxA)
+	}
+
+	pool.release(leaseA.Address)
+	checkAllocator(t, pool)
+
+	if _, found := pool.findClientLease(&a); found {
+		t.Errorf("Released lease still found")
+	}
+}
+
+func TestAllocatorRecyclesLeastRecentlyUsed(t *testing.T) {
+	pool := newTestPool(t, PoolConfig{Network: "10.0.0.0/24", Start: 10, End: 11, Lifetime: "1h"})
+	log := pool.Logger
+
+	a, b, c := testClient(1), testClient(2), testClient(3)
+
+	for _, id := range []ClientIdentifier{a, b} {
+		lease := pool.allocate(&id, log)
+		idx, _ := pool.leaseIndex(lease)
+		lease.State = LeaseInUse
+		pool.putLease(idx, lease)
+		pool.retire(idx, lease)
+	}
+
+	if free := pool.freeCount(); free != 2 {
+		t.Errorf("Free count %d, expected 2", free)
+	}
+
+	oldest, _ := pool.findClientLease(&a)
+	lease := pool.allocate(&c, log)
+	checkAllocator(t, pool)
+
+	if lease == nil || !lease.Address.Equal(oldest.Address) {
+		t.Errorf("Recycled %v, expected %v", lease, oldest.Address)
+	}
+
+	if _, found := pool.findClientLease(&a); found {
+		t.Errorf("Recycled binding still remembered")
+	}
+}
+
+func TestAllocatorReconfigure(t *testing.T) {
+	conf := PoolConfig{Network: "10.0.0.0/24", Start: 10, End: 30, Lifetime: "1h"}
+	pool := newTestPool(t, conf)
+	log := pool.Logger
+
+	for i := 0; i < 15; i++ {
+		id := testClient(i)
+		pool.allocate(&id, log)
+	}
+
+	conf.End = 20
+	conf.Identity = "both"
+
+	if err := pool.Reconfigure(&conf); err != nil {
+		t.Fatal(err)
+	}
+
+	checkAllocator(t, pool)
+}
+
+// fillExpired sets expired lease of distinct client at every index of pool,
+// expiry times shuffled so that rebuild can't rely on map order
+func fillExpired(pool *Pool) {
+	now := time.Now()
+
+	for idx := pool.Start; idx <= pool.End; idx++ {
+		pool.Leases[idx] = &Lease{
+			Address: pool.addressFromIndex(idx),
+			State:   LeaseExpired,
+			ID:      testClient(int(idx)),
+			Expires: now.Add(-time.Duration(idx*7919%pool.End) * time.Second),
+		}
+	}
+}
+
+func TestAllocatorRebuildExpired(t *testing.T) {
+	pool := newTestPool(t, PoolConfig{Network: "10.0.0.0/16", Start: 1, End: 65534, Lifetime: "1h"})
+	fillExpired(pool)
+
+	start := time.Now()
+	pool.rebuildAllocator()
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Rebuild of %d expired leases took %v", len(pool.Leases), elapsed)
+	}
+
+	checkAllocator(t, pool)
+
+	if free := pool.freeCount(); free != 65534 {
+		t.Errorf("Free count %d, expected 65534", free)
+	}
+}
+
+// newBenchmarkPool returns /16 pool with all but last 500 addresses leased
+func newBenchmarkPool(b *testing.B, algo string) *Pool {
+	pool := newTestPool(b, PoolConfig{Network: "10.0.0.0/16", Start: 1, End: 65534, Lifetime: "1h", Algorithm: algo})
+	expires := time.Now().Add(time.Hour)
+
+	for idx := uint32(1); idx <= 65034; idx++ {
+		pool.setLease(idx, &Lease{
+			Address: pool.addressFromIndex(idx),
+			State:   LeaseInUse,
+			ID:      testClient(int(idx)),
+			Expires: expires,
+		})
+	}
+
+	return pool
+}
+
+func BenchmarkPickFree(b *testing.B) {
+	for _, algo := range []string{"sequential", "random", "hashed"} {
+		b.Run(algo, func(b *testing.B) {
+			pool := newBenchmarkPool(b, algo)
+			id := testClient(0x100000)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, found := pool.pickFree(&id); !found {
+					b.Fatal("No address free")
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkFindClientLease(b *testing.B) {
+	pool := newBenchmarkPool(b, "random")
+	id := testClient(40000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, found := pool.findClientLease(&id); !found {
+			b.Fatal("Lease not found")
+		}
+	}
+}
+
+func BenchmarkRebuildExpired(b *testing.B) {
+	pool := newTestPool(b, PoolConfig{Network: "10.0.0.0/16", Start: 1, End: 65534, Lifetime: "1h"})
+	fillExpired(pool)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		pool.rebuildAllocator()
+	}
+}
+
+func newBenchmarkMessage(iface *net.Interface, id ClientIdentifier, t DHCPType) *DirectedDHCPMessage {
+	msg := DHCPMessage{Options: make(DHCPOptions)}
+	msg.BootpOperation = BootRequest
+	msg.HwAddrType = BootpEthernet
+	msg.TransactionID = 1
+	msg.ClientHwAddr = id.Mac
+	msg.ClientIP = net.IPv4zero
+	msg.YourIP = net.IPv4zero
+	msg.ServerIP = net.IPv4zero
+	msg.RelayAgentIP = net.IPv4zero
+
+	msg.Options[DHCPMessageTypeOptionCode] = &Uint8DHCPOption{Value: []uint8{uint8(t)}}
+
+	return &DirectedDHCPMessage{Message: msg, Interface: iface}
+}
+
+// BenchmarkDiscoverRequest measures full DISCOVER, REQUEST exchange of new
+// client in nearly full /16 pool, address is released afterwards
+func BenchmarkDiscoverRequest(b *testing.B) {
+	iface, err := net.InterfaceByName("lo")
+	if err != nil {
+		b.Skip("Loopback interface not found")
+	}
+
+	pool := newBenchmarkPool(b, "random")
+	serverIP := pool.serverIP(iface)
+	sender := make(chan DirectedDHCPMessage, 2)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		id := testClient(0x100000 + i%1000)
+
+		pool.handleDiscover(newBenchmarkMessage(iface, id, DHCPDiscover), sender)
+		offer := <-sender
+
+		request := newBenchmarkMessage(iface, id, DHCPRequest)
+		request.Message.Options[RequestIPAddressOptionCode] = &IPDHCPOption{Value: []net.IP{offer.Message.YourIP}}
+		request.Message.Options[ServerIdentifierOptionCode] = &IPDHCPOption{Value: []net.IP{serverIP}}
+
+		pool.handleRequest(request, sender)
+
+		if ack := <-sender; ack.Message.Type() != DHCPAck {
+			b.Fatalf("Expected ACK, got %v", ack.Message.Type())
+		}
+
+		pool.release(offer.Message.YourIP)
+	}
+}
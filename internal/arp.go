@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	siocsarp        = 0x8955
+	arpHwEthernet   = 1
+	arpFlagComplete = 0x02
+)
+
+// struct arpreq from linux/if_arp.h
+type arpRequest struct {
+	ProtocolAddr syscall.RawSockaddrInet4
+	HwAddr       syscall.RawSockaddr
+	Flags        int32
+	Netmask      syscall.RawSockaddrInet4
+	Device       [16]byte
+}
+
+// AddARPEntry injects neighbour entry so unicast to address
+// not yet configured on client doesn't need ARP resolution
+func AddARPEntry(iface string, ip net.IP, mac net.HardwareAddr) error {
+	ip4 := ip.To4()
+
+	if ip4 == nil {
+		return errors.New("Invalid IPv4 address")
+	}
+
+	if len(mac) != 6 {
+		return errors.New("Only Ethernet hardware addresses are supported")
+	}
+
+	if len(iface) >= 16 {
+		return errors.New("Interface name too long")
+	}
+
+	req := arpRequest{
+		Flags: arpFlagComplete,
+	}
+
+	req.ProtocolAddr.Family = syscall.AF_INET
+	copy(req.ProtocolAddr.Addr[:], ip4)
+
+	req.HwAddr.Family = arpHwEthernet
+	for i, b := range mac {
+		req.HwAddr.Data[i] = int8(b)
+	}
+
+	copy(req.Device[:], iface)
+
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+
+	defer syscall.Close(fd)
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), siocsarp, uintptr(unsafe.Pointer(&req)))
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
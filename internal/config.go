@@ -2,7 +2,6 @@ package internal
 
 import (
 	"fmt"
-
 	"os"
 
 	"sync"
@@ -10,17 +9,128 @@ import (
 	"github.com/BurntSushi/toml"
 )
 
+type HostConfig struct {
+	Mac       string
+	ClientID  string `toml:"client_id"`
+	Address   string
+	Hostname  string
+	CircuitID string `toml:"circuit_id"`
+	RemoteID  string `toml:"remote_id"`
+	// fixed lease time, client's request is ignored
+	Lifetime string
+	Options  OptionsConfig
+}
+
+// ClassConfig overrides lease times for clients with matching vendor class identifier prefix
+type ClassConfig struct {
+	VendorClass string `toml:"vendor_class"`
+	Lifetime    string
+	MinLifetime string `toml:"min_lifetime"`
+	MaxLifetime string `toml:"max_lifetime"`
+}
+
 type PoolConfig struct {
 	Interfaces []string
 	Network    string
 	Start      int
 	End        int
 	Algorithm  string
-	Lifetime   string
+	Identity   string
+	// default lease time, client may ask for other within min and max
+	Lifetime    string
+	MinLifetime string `toml:"min_lifetime"`
+	MaxLifetime string `toml:"max_lifetime"`
+	// T1 and T2 as fraction of lease time, 0.5 and 0.875 when unset
+	Renewal    float64
+	Rebinding  float64
+	Quarantine string
+	// how long offered address is held for client before it's given to others, 1m when unset
+	OfferHold string `toml:"offer_hold"`
+	// none, icmp or arp; ARP falls back to ICMP for relayed clients
+	Probe        string
+	ProbeTimeout string   `toml:"probe_timeout"`
+	CircuitIDs   []string `toml:"circuit_ids"`
+	RemoteIDs    []string `toml:"remote_ids"`
+	Options      OptionsConfig
+	Classes      map[string]ClassConfig
+	Hosts        map[string]HostConfig
+}
+
+type LeaseStoreConfig struct {
+	Type            string
+	Directory       string
+	CompactInterval string `toml:"compact_interval"`
+}
+
+type DelegationConfig struct {
+	Network   string
+	Length    int
+	Algorithm string
+	Lifetime  string
+	Preferred string
+}
+
+type Pool6Config struct {
+	Interfaces   []string
+	Network      string
+	Start        int
+	End          int
+	Algorithm    string
+	Lifetime     string
+	Preferred    string
+	Quarantine   string
+	RapidCommit  bool     `toml:"rapid_commit"`
+	DNSServers   []string `toml:"dns_servers"`
+	DomainSearch []string `toml:"domain_search"`
+	Delegation   DelegationConfig
+}
+
+// AdminConfig enables HTTP/JSON admin API when Listen is set, keep it on loopback
+type AdminConfig struct {
+	Listen string
+}
+
+// MetricsConfig enables Prometheus metrics on /metrics when Listen is set
+type MetricsConfig struct {
+	Listen string
+}
+
+// FailoverConfig pairs two servers serving the same DHCPv4 pools, disabled when Role is empty
+type FailoverConfig struct {
+	// primary or secondary
+	Role string
+	// address secondary accepts primary's connection on
+	Listen string
+	// address of secondary primary connects to
+	Peer string
+	// shared by partners, proves connecting partner knows it
+	Secret    string
+	Heartbeat string
+	// how long partner may stay silent before its addresses are taken over
+	Takeover string
+}
+
+// LogConfig selects logger, empty values mean info level logfmt on stderr
+// without packet dumps
+type LogConfig struct {
+	// debug, info, warn or error
+	Level string
+	// text (logfmt) or json
+	Format string
+	// stderr, stdout or syslog
+	Target string
+	// packet dump verbosity: none, summary or full
+	Dump string
 }
 
 type ConfigFile struct {
-	Pools map[string]PoolConfig
+	Log      LogConfig
+	Leases   LeaseStoreConfig
+	Admin    AdminConfig
+	Metrics  MetricsConfig
+	Failover FailoverConfig
+	Pools    map[string]PoolConfig
+	Pools6   map[string]Pool6Config `toml:"pools6"`
 }
 
 var GlobalConfig ConfigFile
@@ -28,37 +138,80 @@ var once sync.Once
 
 func getDefaultConfig() ConfigFile {
 	return ConfigFile{
+		Leases: LeaseStoreConfig{
+			Type:            "file",
+			Directory:       ".",
+			CompactInterval: "1h",
+		},
 		Pools: map[string]PoolConfig{
 			"default": PoolConfig{
 				Interfaces: []string{
 					"vboxnet0",
 				},
-				Network:   "192.168.99.0/24",
-				Start:     2,
-				End:       99,
-				Algorithm: "random",
-				Lifetime:  "24h",
+				Network:    "192.168.99.0/24",
+				Start:      2,
+				End:        99,
+				Algorithm:  "random",
+				Lifetime:   "24h",
+				Quarantine: "1h",
+				Options: OptionsConfig{
+					Routers:    []string{"192.168.99.1"},
+					DNSServers: []string{"192.168.99.1"},
+				},
 			},
 		},
 	}
 }
 
-func LoadGlobalConfig(file string) {
-	GlobalConfig = LoadConfig(file)
+func LoadGlobalConfig(file string) error {
+	conf, err := LoadConfig(file)
+
+	GlobalConfig = conf
+
+	return err
 }
 
-func LoadConfig(file string) ConfigFile {
+// ReadConfig parses and validates configuration file, unlike LoadConfig it
+// never falls back to defaults. Problems are reported as ConfigErrors, each
+// prefixed with file name and key.
+func ReadConfig(file string) (ConfigFile, error) {
 	var conf ConfigFile
 
-	if _, err := os.Stat(file); os.IsNotExist(err) {
-		fmt.Println("Configuration file not found, using defaults ...")
-		return getDefaultConfig()
+	meta, err := toml.DecodeFile(file, &conf)
+	if err != nil {
+		return conf, fmt.Errorf("%s: %v", file, err)
+	}
+
+	var errs ConfigErrors
+
+	for _, key := range meta.Undecoded() {
+		errs = append(errs, fmt.Errorf("%s: Unknown key", key))
+	}
+
+	if err := ValidateConfig(&conf); err != nil {
+		errs = append(errs, err.(ConfigErrors)...)
 	}
 
-	if _, err := toml.DecodeFile(file, &conf); err != nil {
-		fmt.Println("Unable to load configuration file, using defaults ...", err)
-		return getDefaultConfig()
+	if len(errs) > 0 {
+		for i, err := range errs {
+			errs[i] = fmt.Errorf("%s: %v", file, err)
+		}
+
+		return conf, errs
+	}
+
+	return conf, nil
+}
+
+// LoadConfig reads configuration file, defaults are used only when file doesn't exist
+func LoadConfig(file string) (ConfigFile, error) {
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		Log.Warn("Configuration file not found, using defaults", "path", file)
+
+		conf := getDefaultConfig()
+
+		return conf, ValidateConfig(&conf)
 	}
 
-	return conf
+	return ReadConfig(file)
 }
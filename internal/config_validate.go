@@ -0,0 +1,406 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ConfigErrors lists all problems found in configuration
+type ConfigErrors []error
+
+func (errs ConfigErrors) Error() string {
+	messages := make([]string, len(errs))
+
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+
+	return strings.Join(messages, "\n")
+}
+
+// configChecker collects problems, each prefixed with key it relates to
+type configChecker struct {
+	errors ConfigErrors
+}
+
+func (checker *configChecker) fail(key string, format string, args ...interface{}) {
+	checker.errors = append(checker.errors, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+}
+
+// oneOf checks value against allowed ones, empty string in allowed marks optional value
+func (checker *configChecker) oneOf(key string, value string, allowed ...string) {
+	expected := make([]string, 0, len(allowed))
+
+	for _, option := range allowed {
+		if value == option {
+			return
+		}
+
+		if option != "" {
+			expected = append(expected, option)
+		}
+	}
+
+	checker.fail(key, "Unknown value %q, expected one of: %s", value, strings.Join(expected, ", "))
+}
+
+// duration checks optional duration, required ones are checked by caller
+func (checker *configChecker) duration(key string, value string, required bool) {
+	if value == "" {
+		if required {
+			checker.fail(key, "Value is required")
+		}
+		return
+	}
+
+	if dur, err := time.ParseDuration(value); err != nil {
+		checker.fail(key, "%v", err)
+	} else if dur <= 0 {
+		checker.fail(key, "Duration must be positive")
+	}
+}
+
+func (checker *configChecker) listen(key string, value string) {
+	if value == "" {
+		return
+	}
+
+	if _, _, err := net.SplitHostPort(value); err != nil {
+		checker.fail(key, "%v", err)
+	}
+}
+
+func (checker *configChecker) interfaces(key string, names []string) {
+	for _, name := range names {
+		if _, err := net.InterfaceByName(name); err != nil {
+			checker.fail(key, "Interface %s: %v", name, err)
+		}
+	}
+}
+
+// ValidateConfig checks whole configuration, returns ConfigErrors listing
+// every problem found or nil
+func ValidateConfig(conf *ConfigFile) error {
+	checker := &configChecker{}
+
+	checker.oneOf("leases.type", conf.Leases.Type, "", "file", "memory")
+	checker.duration("leases.compact_interval", conf.Leases.CompactInterval, false)
+
+	if _, err := parseLogLevel(conf.Log.Level); err != nil {
+		checker.fail("log.level", "%v", err)
+	}
+
+	if _, err := parsePacketDump(conf.Log.Dump); err != nil {
+		checker.fail("log.dump", "%v", err)
+	}
+
+	checker.oneOf("log.format", conf.Log.Format, "", "text", "logfmt", "json")
+	checker.oneOf("log.target", conf.Log.Target, "", "stderr", "stdout", "syslog")
+	checker.listen("admin.listen", conf.Admin.Listen)
+	checker.listen("metrics.listen", conf.Metrics.Listen)
+
+	checker.failover(&conf.Failover)
+	checker.pools(conf.Pools)
+	checker.pools6(conf.Pools6)
+
+	if len(checker.errors) > 0 {
+		return checker.errors
+	}
+
+	return nil
+}
+
+func (checker *configChecker) failover(conf *FailoverConfig) {
+	if conf.Role == "" {
+		return
+	}
+
+	checker.oneOf("failover.role", conf.Role, "primary", "secondary")
+	checker.listen("failover.listen", conf.Listen)
+	checker.listen("failover.peer", conf.Peer)
+	checker.duration("failover.heartbeat", conf.Heartbeat, false)
+	checker.duration("failover.takeover", conf.Takeover, false)
+
+	if _, err := NewFailoverPeer(conf); err != nil {
+		checker.fail("failover", "%v", err)
+	}
+}
+
+func sortedPoolNames(pools map[string]PoolConfig) []string {
+	names := make([]string, 0, len(pools))
+
+	for name := range pools {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// addressRange is dynamic range of pool in absolute addresses
+type addressRange struct {
+	pool  string
+	first uint32
+	last  uint32
+}
+
+func (checker *configChecker) pools(pools map[string]PoolConfig) {
+	ranges := make([]addressRange, 0, len(pools))
+	owners := make(map[string]string)
+
+	for _, name := range sortedPoolNames(pools) {
+		conf := pools[name]
+		key := "pools." + name
+
+		checker.oneOf(key+".algorithm", conf.Algorithm, "", "random", "sequential", "hashed")
+		checker.oneOf(key+".identity", conf.Identity, "", "client-id", "mac", "both")
+		checker.duration(key+".lifetime", conf.Lifetime, true)
+		checker.duration(key+".min_lifetime", conf.MinLifetime, false)
+		checker.duration(key+".max_lifetime", conf.MaxLifetime, false)
+		checker.lifetimeBounds(key, conf.Lifetime, conf.MinLifetime, conf.MaxLifetime)
+		checker.duration(key+".quarantine", conf.Quarantine, false)
+		checker.duration(key+".offer_hold", conf.OfferHold, false)
+		checker.oneOf(key+".probe", conf.Probe, "", "none", "icmp", "arp")
+		checker.duration(key+".probe_timeout", conf.ProbeTimeout, false)
+		checker.interfaces(key+".interfaces", conf.Interfaces)
+
+		if _, err := BuildDHCPOptions(&conf.Options); err != nil {
+			checker.fail(key+".options", "%v", err)
+		}
+
+		if _, _, err := renewalTimes(conf.Renewal, conf.Rebinding); err != nil {
+			checker.fail(key+".renewal", "%v", err)
+		}
+
+		checker.classes(key, conf.Classes)
+
+		// interface can't tell apart directly connected clients of unrestricted pools
+		if len(conf.CircuitIDs) == 0 && len(conf.RemoteIDs) == 0 {
+			for _, iface := range conf.Interfaces {
+				if owner, taken := owners[iface]; taken {
+					checker.fail(key+".interfaces", "Interface %s already assigned to pool %s", iface, owner)
+					continue
+				}
+
+				owners[iface] = name
+			}
+		}
+
+		_, network, err := net.ParseCIDR(conf.Network)
+		if err != nil {
+			checker.fail(key+".network", "%v", err)
+			continue
+		}
+
+		if network.IP.To4() == nil {
+			checker.fail(key+".network", "Pool network must be IPv4")
+			continue
+		}
+
+		pool := &Pool{Network: *network}
+		ones, _ := network.Mask.Size()
+		last := int64(1)<<uint(32-ones) - 1
+
+		if ones <= 30 {
+			// network and broadcast addresses
+			if conf.Start < 1 {
+				checker.fail(key+".start", "Start %d is network address", conf.Start)
+			}
+
+			if int64(conf.End) >= last {
+				checker.fail(key+".end", "End %d is broadcast address or outside of network %s", conf.End, network)
+			}
+		} else if conf.Start < 0 || int64(conf.End) > last {
+			checker.fail(key+".end", "Range %d-%d outside of network %s", conf.Start, conf.End, network)
+		}
+
+		if conf.Start > conf.End {
+			checker.fail(key+".start", "Start %d greater than end %d", conf.Start, conf.End)
+		} else if conf.Start >= 0 && int64(conf.End) <= last {
+			ranges = append(ranges, addressRange{
+				pool:  name,
+				first: ipToUint32(pool.addressFromIndex(uint32(conf.Start))),
+				last:  ipToUint32(pool.addressFromIndex(uint32(conf.End))),
+			})
+		}
+
+		checker.hosts(key, pool, conf.Hosts)
+	}
+
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].first < ranges[j].first
+	})
+
+	// compared with range reaching furthest so far, it may cover several following ones
+	var furthest addressRange
+
+	for i, current := range ranges {
+		if i > 0 && current.first <= furthest.last {
+			checker.fail("pools."+current.pool, "Address range overlaps with pool %s", furthest.pool)
+		}
+
+		if i == 0 || current.last > furthest.last {
+			furthest = current
+		}
+	}
+}
+
+// lifetimeBounds checks lifetime within min and max, unparsable values are reported elsewhere
+func (checker *configChecker) lifetimeBounds(key string, lifetime string, min string, max string) {
+	parse := func(value string) time.Duration {
+		duration, _ := time.ParseDuration(value)
+		return duration
+	}
+
+	minimum, maximum := parse(min), parse(max)
+
+	if minimum > 0 && maximum > 0 && minimum > maximum {
+		checker.fail(key+".min_lifetime", "Minimum %s greater than maximum %s", minimum, maximum)
+	}
+
+	if value := parse(lifetime); value > 0 && ((minimum > 0 && value < minimum) || (maximum > 0 && value > maximum)) {
+		checker.fail(key+".lifetime", "Lifetime %s outside of allowed range", value)
+	}
+}
+
+func (checker *configChecker) classes(poolKey string, classes map[string]ClassConfig) {
+	names := make([]string, 0, len(classes))
+
+	for name := range classes {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		conf := classes[name]
+		key := poolKey + ".classes." + name
+
+		if conf.VendorClass == "" {
+			checker.fail(key+".vendor_class", "Value is required")
+		}
+
+		checker.duration(key+".lifetime", conf.Lifetime, false)
+		checker.duration(key+".min_lifetime", conf.MinLifetime, false)
+		checker.duration(key+".max_lifetime", conf.MaxLifetime, false)
+		checker.lifetimeBounds(key, conf.Lifetime, conf.MinLifetime, conf.MaxLifetime)
+	}
+}
+
+func (checker *configChecker) hosts(poolKey string, pool *Pool, hosts map[string]HostConfig) {
+	names := make([]string, 0, len(hosts))
+
+	for name := range hosts {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	addresses := make(map[uint32]string)
+
+	for _, name := range names {
+		conf := hosts[name]
+		key := poolKey + ".hosts." + name
+
+		host, err := newStaticHost(name, &conf)
+		if err != nil {
+			checker.fail(key, "%v", err)
+			continue
+		}
+
+		idx, err := pool.indexFromAddress(host.Address)
+		if err != nil {
+			checker.fail(key+".address", "%v", err)
+			continue
+		}
+
+		if other, taken := addresses[idx]; taken {
+			checker.fail(key+".address", "Address %s already reserved for host %s", host.Address, other)
+			continue
+		}
+
+		addresses[idx] = name
+	}
+}
+
+func (checker *configChecker) pools6(pools map[string]Pool6Config) {
+	names := make([]string, 0, len(pools))
+
+	for name := range pools {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	owners := make(map[string]string)
+
+	for _, name := range names {
+		conf := pools[name]
+		key := "pools6." + name
+
+		checker.oneOf(key+".algorithm", conf.Algorithm, "", "random", "sequential", "hashed")
+		checker.interfaces(key+".interfaces", conf.Interfaces)
+
+		// DHCPv6 pools are selected by interface only
+		for _, iface := range conf.Interfaces {
+			if owner, taken := owners[iface]; taken {
+				checker.fail(key+".interfaces", "Interface %s already assigned to DHCPv6 pool %s", iface, owner)
+				continue
+			}
+
+			owners[iface] = name
+		}
+
+		for _, server := range conf.DNSServers {
+			if ip := net.ParseIP(server); ip == nil || ip.To4() != nil {
+				checker.fail(key+".dns_servers", "Invalid IPv6 address %q", server)
+			}
+		}
+
+		if conf.Network == "" && conf.Delegation.Network == "" {
+			checker.fail(key, "One of network or delegation.network is required")
+		}
+
+		if conf.Network != "" {
+			checker.duration(key+".lifetime", conf.Lifetime, true)
+			checker.duration(key+".preferred", conf.Preferred, false)
+			checker.duration(key+".quarantine", conf.Quarantine, false)
+
+			_, network, err := net.ParseCIDR(conf.Network)
+
+			if err != nil {
+				checker.fail(key+".network", "%v", err)
+			} else if network.IP.To4() != nil {
+				checker.fail(key+".network", "DHCPv6 pool network must be IPv6")
+			} else {
+				ones, _ := network.Mask.Size()
+
+				if conf.Start < 0 || conf.Start > conf.End || (ones >= 96 && int64(conf.End) >= int64(1)<<uint(128-ones)) {
+					checker.fail(key+".end", "Range %d-%d invalid for network %s", conf.Start, conf.End, network)
+				} else if conf.End-conf.Start >= maxPool6Size {
+					checker.fail(key+".end", "Range %d-%d larger than %d addresses", conf.Start, conf.End, maxPool6Size)
+				}
+			}
+		}
+
+		if conf.Delegation.Network != "" {
+			checker.duration(key+".delegation.lifetime", conf.Delegation.Lifetime, true)
+			checker.duration(key+".delegation.preferred", conf.Delegation.Preferred, false)
+			checker.oneOf(key+".delegation.algorithm", conf.Delegation.Algorithm, "", "random", "sequential", "hashed")
+
+			if _, err := parseDelegationBlock(&conf.Delegation); err != nil {
+				checker.fail(key+".delegation", "%v", err)
+			}
+		}
+	}
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	ip4 := ip.To4()
+
+	return uint32(ip4[0])<<24 | uint32(ip4[1])<<16 | uint32(ip4[2])<<8 | uint32(ip4[3])
+}
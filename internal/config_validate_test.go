@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateConfigOverlap(t *testing.T) {
+	pool := func(start int, end int) PoolConfig {
+		return PoolConfig{Network: "10.0.0.0/24", Start: start, End: end, Lifetime: "1h"}
+	}
+
+	conf := &ConfigFile{Pools: map[string]PoolConfig{
+		"a": pool(1, 100),
+		"b": pool(10, 20),
+		"c": pool(30, 40),
+		"d": pool(101, 110),
+	}}
+
+	err := ValidateConfig(conf)
+	if err == nil {
+		t.Fatal("Overlapping pools accepted")
+	}
+
+	errs := err.(ConfigErrors)
+
+	for _, expected := range []string{"pools.b: Address range overlaps with pool a", "pools.c: Address range overlaps with pool a"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Missing %q in:\n%v", expected, err)
+		}
+	}
+
+	if len(errs) != 2 {
+		t.Errorf("Expected 2 errors, got:\n%v", err)
+	}
+}
+
+func TestValidateConfigOptions(t *testing.T) {
+	conf := &ConfigFile{Pools: map[string]PoolConfig{
+		"a": {
+			Network:  "10.0.0.0/24",
+			Start:    10,
+			End:      20,
+			Lifetime: "1h",
+			Renewal:  0.9,
+			Options: OptionsConfig{
+				Custom: []CustomOptionConfig{{Code: 53, Type: "uint8", Value: int64(1)}},
+			},
+		},
+	}}
+
+	err := ValidateConfig(conf)
+	if err == nil {
+		t.Fatal("Invalid options accepted")
+	}
+
+	for _, expected := range []string{
+		"pools.a.options: custom[0]: option 53 is managed by server",
+		"pools.a.renewal: Renewal 0.9 and rebinding 0.875",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Missing %q in:\n%v", expected, err)
+		}
+	}
+}
+
+func TestValidateConfigLongOptionValue(t *testing.T) {
+	long := strings.Repeat("x", 256)
+
+	tests := []struct {
+		name    string
+		options OptionsConfig
+		host    HostConfig
+		err     string
+	}{
+		{
+			"custom string",
+			OptionsConfig{Custom: []CustomOptionConfig{{Code: 224, Type: "string", Value: long}}},
+			HostConfig{},
+			"pools.a.options: option 224: value of 256 bytes longer than 255",
+		},
+		{
+			"custom hex",
+			OptionsConfig{Custom: []CustomOptionConfig{{Code: 43, Type: "hex", Value: strings.Repeat("ab", 256)}}},
+			HostConfig{},
+			"pools.a.options: option 43: value of 256 bytes longer than 255",
+		},
+		{
+			"domain name",
+			OptionsConfig{DomainName: long},
+			HostConfig{},
+			"pools.a.options: option 15: value of 256 bytes longer than 255",
+		},
+		{
+			"host option",
+			OptionsConfig{},
+			HostConfig{Mac: "08:00:27:00:00:01", Address: "10.0.0.5", Options: OptionsConfig{Custom: []CustomOptionConfig{{Code: 224, Type: "string", Value: long}}}},
+			"pools.a.hosts.h: options: option 224: value of 256 bytes longer than 255",
+		},
+		{
+			"longest allowed",
+			OptionsConfig{Custom: []CustomOptionConfig{{Code: 224, Type: "string", Value: long[:255]}}},
+			HostConfig{},
+			"",
+		},
+	}
+
+	for _, test := range tests {
+		pool := PoolConfig{Network: "10.0.0.0/24", Start: 10, End: 20, Lifetime: "1h", Options: test.options}
+
+		if test.host.Address != "" {
+			pool.Hosts = map[string]HostConfig{"h": test.host}
+		}
+
+		err := ValidateConfig(&ConfigFile{Pools: map[string]PoolConfig{"a": pool}})
+
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			}
+			continue
+		}
+
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error %v, expected %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestMarshallDHCPMessageLongOption(t *testing.T) {
+	msg := DHCPMessage{Options: DHCPOptions{DomainNameOptionCode: &StringDHCPOption{Value: strings.Repeat("x", 256)}}}
+
+	if data, err := MarshallDHCPMessage(msg); err == nil {
+		t.Errorf("Message with long option encoded into %d bytes", len(data))
+	}
+}
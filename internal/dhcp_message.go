@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"net"
 	"time"
 )
@@ -42,6 +41,10 @@ const (
 const dhcpMagicCookie uint32 = 0x63825363
 const bootpHeaderSize = 12 + 32 + 64 + 128
 
+// every client must accept datagrams this large, IP and UDP headers included
+const minDHCPMessageSize = 576
+const ipUDPHeaderSize = 20 + 8
+
 // BootpHeader is fixed part of message
 type BootpHeader struct {
 	BootpOperation
@@ -80,6 +83,8 @@ type rawBootpHeader struct {
 type DHCPMessage struct {
 	BootpHeader
 	Options DHCPOptions
+	// OptionOrder lists options to be encoded first, in given order
+	OptionOrder []DHCPOptionCode
 }
 
 func ipToArray(ip net.IP) [4]byte {
@@ -209,48 +214,67 @@ func MarshallDHCPMessage(msg DHCPMessage) ([]byte, error) {
 
 	// header
 	if err := binary.Write(buffer, binary.BigEndian, header); err != nil {
-		return nil, nil
+		return nil, err
 	}
 
 	// cookie
 	if err := binary.Write(buffer, binary.BigEndian, dhcpMagicCookie); err != nil {
-		return nil, nil
+		return nil, err
 	}
 
 	// options
-	opt, err := msg.Options.Encode()
+	opt, err := msg.Options.EncodeOrdered(msg.OptionOrder)
 
 	if err != nil {
-		return nil, nil
+		return nil, err
 	}
 
 	if _, err := buffer.Write(opt); err != nil {
-		return nil, nil
+		return nil, err
 	}
 
 	return buffer.Bytes(), nil
 }
 
-func DebugDHCPMessage(msg *DHCPMessage) {
-	fmt.Println("Nagłówek: ", msg.BootpHeader)
-
-	for code, item := range msg.Options {
-		fmt.Println("Opcja DHCP ", code, item)
-	}
-}
-
 func (msg *DHCPMessage) Type() DHCPType {
 	opt, found := msg.Options[DHCPMessageTypeOptionCode]
 
+	if !found || len(opt.Data().([]uint8)) == 0 {
+		return DHCPUnknown
+	}
+
 	t := opt.Data().([]uint8)[0]
 
-	if !found || t > uint8(DHCPInform) || t == 0 {
+	if t > uint8(DHCPInform) || t == 0 {
 		return DHCPUnknown
 	}
 
 	return DHCPType(t)
 }
 
+func (t DHCPType) String() string {
+	switch t {
+	case DHCPDiscover:
+		return "discover"
+	case DHCPOffer:
+		return "offer"
+	case DHCPRequest:
+		return "request"
+	case DHCPDecline:
+		return "decline"
+	case DHCPAck:
+		return "ack"
+	case DHCPNak:
+		return "nak"
+	case DHCPRelease:
+		return "release"
+	case DHCPInform:
+		return "inform"
+	}
+
+	return "unknown"
+}
+
 func (msg *DHCPMessage) RequestedIP() net.IP {
 	opt, found := msg.Options[RequestIPAddressOptionCode]
 
@@ -261,6 +285,91 @@ func (msg *DHCPMessage) RequestedIP() net.IP {
 	return opt.Data().([]net.IP)[0]
 }
 
+// ClientID returns client identifier option value, nil if absent or empty
+func (msg *DHCPMessage) ClientID() []uint8 {
+	opt, found := msg.Options[ClientIdentifierOptionCode]
+
+	if !found || len(opt.Data().([]uint8)) == 0 {
+		return nil
+	}
+
+	return opt.Data().([]uint8)
+}
+
+// RequestedLeaseTime returns lease time asked for by client, zero when absent
+func (msg *DHCPMessage) RequestedLeaseTime() time.Duration {
+	opt, found := msg.Options[IPAddressLeaseTimeOptionCode]
+
+	if !found {
+		return 0
+	}
+
+	return opt.Data().(time.Duration)
+}
+
+// VendorClass returns vendor class identifier option value, empty if absent
+func (msg *DHCPMessage) VendorClass() string {
+	opt, found := msg.Options[VendorClassIdentifierOptionCode]
+
+	if !found {
+		return ""
+	}
+
+	return opt.Data().(string)
+}
+
+// ParameterRequestList returns requested option codes, nil if client didn't send the list
+func (msg *DHCPMessage) ParameterRequestList() []DHCPOptionCode {
+	opt, found := msg.Options[ParameterRequestListOptionCode]
+
+	if !found {
+		return nil
+	}
+
+	list := opt.Data().([]uint8)
+	codes := make([]DHCPOptionCode, len(list))
+
+	for i, code := range list {
+		codes[i] = DHCPOptionCode(code)
+	}
+
+	return codes
+}
+
+// MaxMessageSize returns largest IP datagram client accepts
+func (msg *DHCPMessage) MaxMessageSize() int {
+	opt, found := msg.Options[MaximumDHCPMessageSizeOptionCode]
+
+	if !found || len(opt.Data().([]uint16)) == 0 {
+		return minDHCPMessageSize
+	}
+
+	size := int(opt.Data().([]uint16)[0])
+
+	if size < minDHCPMessageSize {
+		return minDHCPMessageSize
+	}
+
+	return size
+}
+
+// Relayed tells whether message came through relay agent
+func (msg *DHCPMessage) Relayed() bool {
+	return msg.RelayAgentIP != nil && !msg.RelayAgentIP.Equal(net.IPv4zero)
+}
+
+// RelayAgentInfo returns option 82 of relayed message, nil if absent. RFC 3046
+// 2.1: option of unrelayed message came from client itself and is ignored.
+func (msg *DHCPMessage) RelayAgentInfo() *RelayAgentInfoDHCPOption {
+	opt, found := msg.Options[RelayAgentInformationOptionCode]
+
+	if !found || !msg.Relayed() {
+		return nil
+	}
+
+	return opt.(*RelayAgentInfoDHCPOption)
+}
+
 func (msg *DHCPMessage) ServerIdentifier() net.IP {
 	opt, found := msg.Options[ServerIdentifierOptionCode]
 
@@ -278,9 +387,9 @@ func BuildBasicReply(request *DHCPMessage, serverIP net.IP) DHCPMessage {
 		Hops:           request.Hops,
 		TransactionID:  request.TransactionID,
 		Seconds:        request.Seconds,
-		Flags:          BootpBroadcast,
+		Flags:          request.Flags,
 		ServerIP:       serverIP,
-		RelayAgentIP:   net.IPv4zero,
+		RelayAgentIP:   request.RelayAgentIP,
 		ClientIP:       net.IPv4zero,
 		YourIP:         net.IPv4zero,
 		ClientHwAddr:   request.ClientHwAddr,
@@ -292,6 +401,12 @@ func BuildBasicReply(request *DHCPMessage, serverIP net.IP) DHCPMessage {
 		Value: []net.IP{serverIP},
 	}
 
+	// RFC 3046 2.2: relay agent information is echoed back unchanged,
+	// never to clients sending it themselves
+	if info := request.RelayAgentInfo(); info != nil {
+		options[RelayAgentInformationOptionCode] = info
+	}
+
 	return DHCPMessage{
 		BootpHeader: header,
 		Options:     options,
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sort"
 	"time"
 )
 
@@ -38,6 +39,7 @@ const (
 	RebindingTimeValueOptionCode     DHCPOptionCode = 59
 	VendorClassIdentifierOptionCode  DHCPOptionCode = 60
 	ClientIdentifierOptionCode       DHCPOptionCode = 61
+	RelayAgentInformationOptionCode  DHCPOptionCode = 82
 	EndOptionCode                    DHCPOptionCode = 255
 )
 
@@ -126,6 +128,8 @@ func decodeOption(code DHCPOptionCode, data []byte) (DHCPOption, error) {
 	// uint16
 	case InterfaceMTUOptionCode, MaximumDHCPMessageSizeOptionCode:
 		opt = &Uint16DHCPOption{}
+	case RelayAgentInformationOptionCode:
+		opt = &RelayAgentInfoDHCPOption{}
 	default:
 		return nil, nil
 	}
@@ -138,16 +142,41 @@ func decodeOption(code DHCPOptionCode, data []byte) (DHCPOption, error) {
 }
 
 func (options DHCPOptions) Encode() ([]byte, error) {
+	return options.EncodeOrdered(nil)
+}
+
+// EncodeOrdered writes options listed in order first, then the rest by code
+func (options DHCPOptions) EncodeOrdered(order []DHCPOptionCode) ([]byte, error) {
 	var buffer bytes.Buffer
 
-	for code, opt := range options {
+	written := make(map[DHCPOptionCode]bool, len(options))
+	codes := make([]DHCPOptionCode, 0, len(options))
+
+	for _, code := range order {
+		if _, found := options[code]; found && !written[code] {
+			codes = append(codes, code)
+			written[code] = true
+		}
+	}
+
+	rest := make([]DHCPOptionCode, 0, len(options))
+
+	for code := range options {
+		if !written[code] {
+			rest = append(rest, code)
+		}
+	}
+
+	sort.Slice(rest, func(i, j int) bool { return rest[i] < rest[j] })
+
+	for _, code := range append(codes, rest...) {
 		if code == EndOptionCode || code == PadOptionCode {
 			continue
 		} else {
 			buffer.WriteByte(byte(code))
-			data := opt.Encode()
+			data := options[code].Encode()
 
-			if len(data) > 255 {
+			if len(data) > maxOptionLength {
 				return nil, errors.New("Option taking more than 255 bytes detected")
 			}
 
@@ -0,0 +1,174 @@
+package internal
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+type DHCPv6Type uint8
+
+const (
+	DHCPv6Solicit            DHCPv6Type = 1
+	DHCPv6Advertise          DHCPv6Type = 2
+	DHCPv6Request            DHCPv6Type = 3
+	DHCPv6Confirm            DHCPv6Type = 4
+	DHCPv6Renew              DHCPv6Type = 5
+	DHCPv6Rebind             DHCPv6Type = 6
+	DHCPv6Reply              DHCPv6Type = 7
+	DHCPv6Release            DHCPv6Type = 8
+	DHCPv6Decline            DHCPv6Type = 9
+	DHCPv6Reconfigure        DHCPv6Type = 10
+	DHCPv6InformationRequest DHCPv6Type = 11
+	DHCPv6RelayForward       DHCPv6Type = 12
+	DHCPv6RelayReply         DHCPv6Type = 13
+)
+
+const dhcpv6HeaderSize = 4
+
+// DHCPv6Message is client/server message, RFC 8415 section 8
+type DHCPv6Message struct {
+	Type          DHCPv6Type
+	TransactionID uint32
+	Options       DHCPv6Options
+}
+
+func UnmarshallDHCPv6Message(msg []byte) (DHCPv6Message, error) {
+	var out DHCPv6Message
+
+	if len(msg) < dhcpv6HeaderSize {
+		return out, errors.New("DHCPv6 message too short")
+	}
+
+	out.Type = DHCPv6Type(msg[0])
+	out.TransactionID = binary.BigEndian.Uint32(msg) & 0xFFFFFF
+
+	if out.Type == DHCPv6RelayForward || out.Type == DHCPv6RelayReply {
+		return out, errors.New("DHCPv6 relay messages are not supported")
+	}
+
+	options, err := DecodeDHCPv6Options(msg[dhcpv6HeaderSize:])
+	if err != nil {
+		return out, err
+	}
+
+	out.Options = options
+
+	return out, nil
+}
+
+func MarshallDHCPv6Message(msg DHCPv6Message) []byte {
+	header := make([]byte, dhcpv6HeaderSize)
+	binary.BigEndian.PutUint32(header, msg.TransactionID&0xFFFFFF)
+	header[0] = byte(msg.Type)
+
+	return append(header, msg.Options.Encode()...)
+}
+
+func (t DHCPv6Type) String() string {
+	switch t {
+	case DHCPv6Solicit:
+		return "solicit"
+	case DHCPv6Advertise:
+		return "advertise"
+	case DHCPv6Request:
+		return "request"
+	case DHCPv6Confirm:
+		return "confirm"
+	case DHCPv6Renew:
+		return "renew"
+	case DHCPv6Rebind:
+		return "rebind"
+	case DHCPv6Reply:
+		return "reply"
+	case DHCPv6Release:
+		return "release"
+	case DHCPv6Decline:
+		return "decline"
+	case DHCPv6Reconfigure:
+		return "reconfigure"
+	case DHCPv6InformationRequest:
+		return "information-request"
+	case DHCPv6RelayForward:
+		return "relay-forward"
+	case DHCPv6RelayReply:
+		return "relay-reply"
+	}
+
+	return "unknown"
+}
+
+func (msg *DHCPv6Message) ClientDUID() []byte {
+	duid, _ := msg.Options.Get(ClientIDv6OptionCode)
+
+	return duid
+}
+
+func (msg *DHCPv6Message) ServerDUID() []byte {
+	duid, _ := msg.Options.Get(ServerIDv6OptionCode)
+
+	return duid
+}
+
+func (msg *DHCPv6Message) IANAs() []IANA {
+	result := make([]IANA, 0)
+
+	for _, data := range msg.Options.GetAll(IANAv6OptionCode) {
+		if ia, err := DecodeIANA(data); err == nil {
+			result = append(result, ia)
+		}
+	}
+
+	return result
+}
+
+func (msg *DHCPv6Message) IAPDs() []IAPD {
+	result := make([]IAPD, 0)
+
+	for _, data := range msg.Options.GetAll(IAPDv6OptionCode) {
+		if ia, err := DecodeIAPD(data); err == nil {
+			result = append(result, ia)
+		}
+	}
+
+	return result
+}
+
+func (msg *DHCPv6Message) RequestedOptions() []DHCPv6OptionCode {
+	data, found := msg.Options.Get(OptionRequestv6OptionCode)
+
+	if !found {
+		return nil
+	}
+
+	return DecodeOptionRequest(data)
+}
+
+func (msg *DHCPv6Message) RapidCommit() bool {
+	_, found := msg.Options.Get(RapidCommitv6OptionCode)
+
+	return found
+}
+
+// NewDUIDLL builds link-layer address DUID, RFC 8415 11.4
+func NewDUIDLL(hwAddr net.HardwareAddr) []byte {
+	duid := make([]byte, 4, 4+len(hwAddr))
+	binary.BigEndian.PutUint16(duid, 3)
+	binary.BigEndian.PutUint16(duid[2:], uint16(BootpEthernet))
+
+	return append(duid, hwAddr...)
+}
+
+// BuildBasicReplyv6 creates reply carrying client and server identifiers
+func BuildBasicReplyv6(request *DHCPv6Message, t DHCPv6Type, serverDUID []byte) DHCPv6Message {
+	reply := DHCPv6Message{
+		Type:          t,
+		TransactionID: request.TransactionID,
+		Options:       make(DHCPv6Options, 0),
+	}
+
+	reply.Options.Add(ServerIDv6OptionCode, serverDUID)
+	reply.Options.Add(ClientIDv6OptionCode, request.ClientDUID())
+
+	return reply
+}
@@ -0,0 +1,362 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+type DHCPv6OptionCode uint16
+type DHCPv6StatusCode uint16
+
+const (
+	ClientIDv6OptionCode      DHCPv6OptionCode = 1
+	ServerIDv6OptionCode      DHCPv6OptionCode = 2
+	IANAv6OptionCode          DHCPv6OptionCode = 3
+	IAAddressv6OptionCode     DHCPv6OptionCode = 5
+	OptionRequestv6OptionCode DHCPv6OptionCode = 6
+	Preferencev6OptionCode    DHCPv6OptionCode = 7
+	ElapsedTimev6OptionCode   DHCPv6OptionCode = 8
+	StatusCodev6OptionCode    DHCPv6OptionCode = 13
+	RapidCommitv6OptionCode   DHCPv6OptionCode = 14
+	DNSServersv6OptionCode    DHCPv6OptionCode = 23
+	DomainListv6OptionCode    DHCPv6OptionCode = 24
+	IAPDv6OptionCode          DHCPv6OptionCode = 25
+	IAPrefixv6OptionCode      DHCPv6OptionCode = 26
+)
+
+const (
+	DHCPv6Success       DHCPv6StatusCode = 0
+	DHCPv6UnspecFail    DHCPv6StatusCode = 1
+	DHCPv6NoAddrsAvail  DHCPv6StatusCode = 2
+	DHCPv6NoBinding     DHCPv6StatusCode = 3
+	DHCPv6NotOnLink     DHCPv6StatusCode = 4
+	DHCPv6UseMulticast  DHCPv6StatusCode = 5
+	DHCPv6NoPrefixAvail DHCPv6StatusCode = 6
+)
+
+// DHCPv6Option is raw option, typed views are decoded on demand
+// since options may repeat and nest
+type DHCPv6Option struct {
+	Code DHCPv6OptionCode
+	Data []byte
+}
+
+type DHCPv6Options []DHCPv6Option
+
+// IANA is identity association for non-temporary addresses
+type IANA struct {
+	IAID    uint32
+	T1      time.Duration
+	T2      time.Duration
+	Options DHCPv6Options
+}
+
+// IAPD is identity association for prefix delegation, RFC 8415 21.21.
+// It shares IA_NA layout, only sub-options differ.
+type IAPD IANA
+
+type IAPrefix struct {
+	Preferred time.Duration
+	Valid     time.Duration
+	Prefix    net.IPNet
+	Options   DHCPv6Options
+}
+
+type IAAddress struct {
+	Address   net.IP
+	Preferred time.Duration
+	Valid     time.Duration
+	Options   DHCPv6Options
+}
+
+func DecodeDHCPv6Options(data []byte) (DHCPv6Options, error) {
+	options := make(DHCPv6Options, 0)
+
+	for i := 0; i < len(data); {
+		if len(data)-i < 4 {
+			return nil, errors.New("Truncated DHCPv6 option header")
+		}
+
+		code := DHCPv6OptionCode(binary.BigEndian.Uint16(data[i:]))
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+
+		if length > len(data)-i-4 {
+			return nil, errors.New("Invalid DHCPv6 option length")
+		}
+
+		opt := DHCPv6Option{
+			Code: code,
+			Data: make([]byte, length),
+		}
+		copy(opt.Data, data[i+4:i+4+length])
+
+		options = append(options, opt)
+		i += 4 + length
+	}
+
+	return options, nil
+}
+
+func (options DHCPv6Options) Encode() []byte {
+	var buffer bytes.Buffer
+
+	for _, opt := range options {
+		binary.Write(&buffer, binary.BigEndian, uint16(opt.Code))
+		binary.Write(&buffer, binary.BigEndian, uint16(len(opt.Data)))
+		buffer.Write(opt.Data)
+	}
+
+	return buffer.Bytes()
+}
+
+// Get returns data of first option with given code
+func (options DHCPv6Options) Get(code DHCPv6OptionCode) ([]byte, bool) {
+	for _, opt := range options {
+		if opt.Code == code {
+			return opt.Data, true
+		}
+	}
+
+	return nil, false
+}
+
+func (options DHCPv6Options) GetAll(code DHCPv6OptionCode) [][]byte {
+	result := make([][]byte, 0)
+
+	for _, opt := range options {
+		if opt.Code == code {
+			result = append(result, opt.Data)
+		}
+	}
+
+	return result
+}
+
+func (options *DHCPv6Options) Add(code DHCPv6OptionCode, data []byte) {
+	*options = append(*options, DHCPv6Option{
+		Code: code,
+		Data: data,
+	})
+}
+
+func (options *DHCPv6Options) AddStatus(status DHCPv6StatusCode, message string) {
+	data := make([]byte, 2+len(message))
+	binary.BigEndian.PutUint16(data, uint16(status))
+	copy(data[2:], message)
+
+	options.Add(StatusCodev6OptionCode, data)
+}
+
+// Status returns status code option value, success when absent
+func (options DHCPv6Options) Status() DHCPv6StatusCode {
+	data, found := options.Get(StatusCodev6OptionCode)
+
+	if !found || len(data) < 2 {
+		return DHCPv6Success
+	}
+
+	return DHCPv6StatusCode(binary.BigEndian.Uint16(data))
+}
+
+func secondsToDuration(seconds uint32) time.Duration {
+	return time.Duration(seconds) * time.Second
+}
+
+func durationToSeconds(dur time.Duration) uint32 {
+	if dur < 0 {
+		return 0
+	}
+
+	seconds := dur / time.Second
+
+	if seconds > 0xFFFFFFFF {
+		return 0xFFFFFFFF
+	}
+
+	return uint32(seconds)
+}
+
+func DecodeIANA(data []byte) (IANA, error) {
+	var ia IANA
+
+	if len(data) < 12 {
+		return ia, errors.New("Truncated IA option")
+	}
+
+	ia.IAID = binary.BigEndian.Uint32(data)
+	ia.T1 = secondsToDuration(binary.BigEndian.Uint32(data[4:]))
+	ia.T2 = secondsToDuration(binary.BigEndian.Uint32(data[8:]))
+
+	options, err := DecodeDHCPv6Options(data[12:])
+	if err != nil {
+		return ia, err
+	}
+
+	ia.Options = options
+
+	return ia, nil
+}
+
+func (ia *IANA) Encode() []byte {
+	data := make([]byte, 12)
+
+	binary.BigEndian.PutUint32(data, ia.IAID)
+	binary.BigEndian.PutUint32(data[4:], durationToSeconds(ia.T1))
+	binary.BigEndian.PutUint32(data[8:], durationToSeconds(ia.T2))
+
+	return append(data, ia.Options.Encode()...)
+}
+
+// Addresses returns all well formed IA address sub-options
+func (ia *IANA) Addresses() []IAAddress {
+	result := make([]IAAddress, 0)
+
+	for _, data := range ia.Options.GetAll(IAAddressv6OptionCode) {
+		if addr, err := DecodeIAAddress(data); err == nil {
+			result = append(result, addr)
+		}
+	}
+
+	return result
+}
+
+func DecodeIAAddress(data []byte) (IAAddress, error) {
+	var addr IAAddress
+
+	if len(data) < 24 {
+		return addr, errors.New("Truncated IA address option")
+	}
+
+	addr.Address = make(net.IP, net.IPv6len)
+	copy(addr.Address, data[:16])
+	addr.Preferred = secondsToDuration(binary.BigEndian.Uint32(data[16:]))
+	addr.Valid = secondsToDuration(binary.BigEndian.Uint32(data[20:]))
+
+	options, err := DecodeDHCPv6Options(data[24:])
+	if err != nil {
+		return addr, err
+	}
+
+	addr.Options = options
+
+	return addr, nil
+}
+
+func (addr *IAAddress) Encode() []byte {
+	data := make([]byte, 24)
+
+	copy(data, addr.Address.To16())
+	binary.BigEndian.PutUint32(data[16:], durationToSeconds(addr.Preferred))
+	binary.BigEndian.PutUint32(data[20:], durationToSeconds(addr.Valid))
+
+	return append(data, addr.Options.Encode()...)
+}
+
+func DecodeIAPD(data []byte) (IAPD, error) {
+	ia, err := DecodeIANA(data)
+
+	return IAPD(ia), err
+}
+
+func (ia *IAPD) Encode() []byte {
+	return (*IANA)(ia).Encode()
+}
+
+// Prefixes returns all well formed IA prefix sub-options
+func (ia *IAPD) Prefixes() []IAPrefix {
+	result := make([]IAPrefix, 0)
+
+	for _, data := range ia.Options.GetAll(IAPrefixv6OptionCode) {
+		if prefix, err := DecodeIAPrefix(data); err == nil {
+			result = append(result, prefix)
+		}
+	}
+
+	return result
+}
+
+func DecodeIAPrefix(data []byte) (IAPrefix, error) {
+	var prefix IAPrefix
+
+	if len(data) < 25 {
+		return prefix, errors.New("Truncated IA prefix option")
+	}
+
+	length := int(data[8])
+
+	if length > 128 {
+		return prefix, errors.New("Invalid IA prefix length")
+	}
+
+	prefix.Preferred = secondsToDuration(binary.BigEndian.Uint32(data))
+	prefix.Valid = secondsToDuration(binary.BigEndian.Uint32(data[4:]))
+	prefix.Prefix.Mask = net.CIDRMask(length, 128)
+	prefix.Prefix.IP = make(net.IP, net.IPv6len)
+	copy(prefix.Prefix.IP, data[9:25])
+
+	options, err := DecodeDHCPv6Options(data[25:])
+	if err != nil {
+		return prefix, err
+	}
+
+	prefix.Options = options
+
+	return prefix, nil
+}
+
+func (prefix *IAPrefix) Encode() []byte {
+	data := make([]byte, 25)
+	length, _ := prefix.Prefix.Mask.Size()
+
+	binary.BigEndian.PutUint32(data, durationToSeconds(prefix.Preferred))
+	binary.BigEndian.PutUint32(data[4:], durationToSeconds(prefix.Valid))
+	data[8] = byte(length)
+	copy(data[9:], prefix.Prefix.IP.To16())
+
+	return append(data, prefix.Options.Encode()...)
+}
+
+// DecodeOptionRequest returns codes listed in option request option
+func DecodeOptionRequest(data []byte) []DHCPv6OptionCode {
+	codes := make([]DHCPv6OptionCode, 0, len(data)/2)
+
+	for i := 0; i+1 < len(data); i += 2 {
+		codes = append(codes, DHCPv6OptionCode(binary.BigEndian.Uint16(data[i:])))
+	}
+
+	return codes
+}
+
+func encodeIPv6List(ips []net.IP) []byte {
+	data := make([]byte, 0, len(ips)*net.IPv6len)
+
+	for _, ip := range ips {
+		data = append(data, ip.To16()...)
+	}
+
+	return data
+}
+
+// encodeDomainList encodes names in RFC 1035 wire format, without compression
+func encodeDomainList(domains []string) []byte {
+	var buffer bytes.Buffer
+
+	for _, domain := range domains {
+		for _, label := range strings.Split(domain, ".") {
+			if label == "" {
+				continue
+			}
+
+			buffer.WriteByte(byte(len(label)))
+			buffer.WriteString(label)
+		}
+
+		buffer.WriteByte(0)
+	}
+
+	return buffer.Bytes()
+}
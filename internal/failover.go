@@ -0,0 +1,557 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type FailoverRole int
+
+const (
+	// connects to partner, allocates from lower half of dynamic ranges
+	FailoverPrimary FailoverRole = iota
+	// accepts partner connection, allocates from upper half
+	FailoverSecondary FailoverRole = iota
+)
+
+const (
+	failoverHello     = "hello"
+	failoverAuth      = "auth"
+	failoverHeartbeat = "heartbeat"
+	failoverBinding   = "binding"
+	// queued binding updates, connection is reset and resynced when exceeded
+	failoverQueueSize = 1024
+	// length of random challenge sent in hello
+	failoverNonceSize = 16
+)
+
+func (role FailoverRole) String() string {
+	if role == FailoverSecondary {
+		return "secondary"
+	}
+
+	return "primary"
+}
+
+// failoverMessage is single JSON line exchanged between partners
+type failoverMessage struct {
+	Type string `json:"type"`
+	Role string `json:"role,omitempty"`
+	// hello carries challenge, auth answers partner's one
+	Nonce  string       `json:"nonce,omitempty"`
+	Proof  string       `json:"proof,omitempty"`
+	Pool   string       `json:"pool,omitempty"`
+	Record *leaseRecord `json:"record,omitempty"`
+}
+
+// FailoverPeer keeps DHCPv4 bindings in sync with partner server over TCP.
+// Dynamic range of every pool is split in halves so partners never hand out
+// the same address. Partner silent for longer than Takeover is considered
+// down and its half is used as well, until it comes back. Partners prove
+// knowledge of shared Secret when connecting, connection is dropped otherwise.
+type FailoverPeer struct {
+	Role      FailoverRole
+	Listen    string
+	Address   string
+	Secret    []byte
+	Heartbeat time.Duration
+	Takeover  time.Duration
+	Logger    *slog.Logger
+
+	pools   *PoolSet
+	updates chan failoverMessage
+	// unix nanoseconds of last message from partner
+	lastSeen  int64
+	connected int32
+
+	mutex sync.Mutex
+	conn  net.Conn
+}
+
+func NewFailoverPeer(conf *FailoverConfig) (*FailoverPeer, error) {
+	peer := &FailoverPeer{
+		Listen:    conf.Listen,
+		Address:   conf.Peer,
+		Secret:    []byte(conf.Secret),
+		Heartbeat: 5 * time.Second,
+		Takeover:  30 * time.Second,
+		Logger:    Log.With("failover", conf.Role),
+		updates:   make(chan failoverMessage, failoverQueueSize),
+		// partner gets full takeover time to show up after start
+		lastSeen: time.Now().UnixNano(),
+	}
+
+	switch conf.Role {
+	case "primary":
+		peer.Role = FailoverPrimary
+
+		if peer.Address == "" {
+			return nil, errors.New("Primary needs peer address")
+		}
+	case "secondary":
+		peer.Role = FailoverSecondary
+
+		if peer.Listen == "" {
+			return nil, errors.New("Secondary needs listen address")
+		}
+	default:
+		return nil, fmt.Errorf("Unknown failover role: %s", conf.Role)
+	}
+
+	if conf.Secret == "" {
+		return nil, errors.New("Failover needs shared secret")
+	}
+
+	var err error
+
+	if conf.Heartbeat != "" {
+		if peer.Heartbeat, err = time.ParseDuration(conf.Heartbeat); err != nil {
+			return nil, fmt.Errorf("heartbeat: %v", err)
+		}
+	}
+
+	if conf.Takeover != "" {
+		if peer.Takeover, err = time.ParseDuration(conf.Takeover); err != nil {
+			return nil, fmt.Errorf("takeover: %v", err)
+		}
+	}
+
+	if peer.Takeover <= peer.Heartbeat {
+		return nil, errors.New("Takeover time must be longer than heartbeat interval")
+	}
+
+	return peer, nil
+}
+
+// PartnerUp reports whether partner was heard of within takeover time
+func (peer *FailoverPeer) PartnerUp() bool {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&peer.lastSeen))) < peer.Takeover
+}
+
+// share returns part of dynamic range start..end this server may allocate
+// from, nil peer owns everything. Range is empty (lo > hi) when there's none.
+// Both partners own whole range while they don't hear of each other, so with
+// network split between them they may hand out the same address; conflicting
+// bindings are resolved by applyBinding once they reconnect.
+func (peer *FailoverPeer) share(start uint32, end uint32) (uint32, uint32) {
+	if peer == nil || !peer.PartnerUp() {
+		return start, end
+	}
+
+	middle := start + (end-start)/2
+
+	if peer.Role == FailoverPrimary {
+		return start, middle
+	}
+
+	return middle + 1, end
+}
+
+// Run connects to or accepts partner and exchanges bindings of pools until
+// listening fails, reconnecting whenever connection breaks
+func (peer *FailoverPeer) Run(pools *PoolSet) error {
+	peer.pools = pools
+
+	go peer.monitor()
+
+	if peer.Role == FailoverSecondary {
+		listener, err := net.Listen("tcp", peer.Listen)
+		if err != nil {
+			return err
+		}
+
+		peer.Logger.Info("Waiting for failover partner", "address", peer.Listen)
+
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return err
+			}
+
+			go peer.serve(conn)
+		}
+	}
+
+	for {
+		conn, err := net.DialTimeout("tcp", peer.Address, peer.Heartbeat)
+
+		if err != nil {
+			peer.Logger.Debug("Unable to connect to failover partner", "address", peer.Address, "error", err)
+		} else {
+			peer.serve(conn)
+		}
+
+		time.Sleep(peer.Heartbeat)
+	}
+}
+
+// monitor logs partner state changes
+func (peer *FailoverPeer) monitor() {
+	up := true
+
+	for range time.Tick(peer.Heartbeat) {
+		if now := peer.PartnerUp(); now != up {
+			if now {
+				peer.Logger.Info("Failover partner is back, allocating from own half of pools")
+			} else {
+				peer.Logger.Warn("Failover partner down, taking over its half of pools", "silent", peer.Takeover)
+			}
+
+			up = now
+		}
+	}
+}
+
+func (peer *FailoverPeer) serve(conn net.Conn) {
+	log := peer.Logger.With("partner", conn.RemoteAddr().String())
+
+	encoder := json.NewEncoder(conn)
+	decoder := json.NewDecoder(conn)
+
+	if err := peer.handshake(conn, encoder, decoder); err != nil {
+		log.Warn("Failover partner rejected", "error", err)
+		conn.Close()
+		return
+	}
+
+	log.Info("Failover partner connected")
+	atomic.StoreInt64(&peer.lastSeen, time.Now().UnixNano())
+
+	// reconnecting partner replaces stale connection
+	peer.mutex.Lock()
+	if peer.conn != nil {
+		peer.conn.Close()
+	}
+	peer.conn = conn
+	peer.mutex.Unlock()
+
+	done := make(chan struct{})
+	go peer.write(conn, encoder, done, log)
+
+	err := peer.read(conn, decoder)
+
+	close(done)
+	conn.Close()
+
+	peer.mutex.Lock()
+	if peer.conn == conn {
+		peer.conn = nil
+		atomic.StoreInt32(&peer.connected, 0)
+	}
+	peer.mutex.Unlock()
+
+	log.Warn("Failover partner disconnected", "error", err)
+}
+
+func (peer *FailoverPeer) partnerRole() string {
+	if peer.Role == FailoverPrimary {
+		return FailoverSecondary.String()
+	}
+
+	return FailoverPrimary.String()
+}
+
+// proof returns HMAC of challenge and role answering to it
+func (peer *FailoverPeer) proof(nonce []byte, role string) []byte {
+	mac := hmac.New(sha256.New, peer.Secret)
+	mac.Write(nonce)
+	mac.Write([]byte(role))
+
+	return mac.Sum(nil)
+}
+
+// handshake exchanges challenges with partner, both sides answer the other's
+// one with HMAC keyed by shared secret before any binding is sent or accepted
+func (peer *FailoverPeer) handshake(conn net.Conn, encoder *json.Encoder, decoder *json.Decoder) error {
+	conn.SetDeadline(time.Now().Add(peer.Takeover))
+	defer conn.SetDeadline(time.Time{})
+
+	nonce := make([]byte, failoverNonceSize)
+
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	role := peer.Role.String()
+
+	if err := encoder.Encode(failoverMessage{Type: failoverHello, Role: role, Nonce: hex.EncodeToString(nonce)}); err != nil {
+		return err
+	}
+
+	var hello failoverMessage
+
+	if err := decoder.Decode(&hello); err != nil {
+		return err
+	}
+
+	if hello.Type != failoverHello {
+		return fmt.Errorf("Expected hello, got %q", hello.Type)
+	}
+
+	if hello.Role != peer.partnerRole() {
+		return fmt.Errorf("Partner has role %q, expected %s", hello.Role, peer.partnerRole())
+	}
+
+	challenge, err := hex.DecodeString(hello.Nonce)
+	if err != nil || len(challenge) != failoverNonceSize {
+		return errors.New("Invalid challenge")
+	}
+
+	proof := peer.proof(challenge, role)
+
+	if err := encoder.Encode(failoverMessage{Type: failoverAuth, Proof: hex.EncodeToString(proof)}); err != nil {
+		return err
+	}
+
+	var auth failoverMessage
+
+	if err := decoder.Decode(&auth); err != nil {
+		return err
+	}
+
+	answer, err := hex.DecodeString(auth.Proof)
+
+	if auth.Type != failoverAuth || err != nil || !hmac.Equal(answer, peer.proof(nonce, peer.partnerRole())) {
+		return errors.New("Authentication failed, check secret")
+	}
+
+	return nil
+}
+
+// write sends all current bindings first, then streams updates and heartbeats
+func (peer *FailoverPeer) write(conn net.Conn, encoder *json.Encoder, done <-chan struct{}, log *slog.Logger) {
+	send := func(msg failoverMessage) bool {
+		conn.SetWriteDeadline(time.Now().Add(peer.Takeover))
+
+		if err := encoder.Encode(msg); err != nil {
+			log.Warn("Unable to send to failover partner", "error", err)
+			conn.Close()
+			return false
+		}
+
+		return true
+	}
+
+	// updates queued before snapshot are part of it
+	atomic.StoreInt32(&peer.connected, 1)
+
+Drain:
+	for {
+		select {
+		case <-peer.updates:
+		default:
+			break Drain
+		}
+	}
+
+	count := 0
+
+	for _, pool := range peer.pools.Pools() {
+		var records []*leaseRecord
+
+		pool.Do(func() { records = pool.bindingRecords() })
+
+		for _, record := range records {
+			if !send(failoverMessage{Type: failoverBinding, Pool: pool.Name, Record: record}) {
+				return
+			}
+		}
+
+		count += len(records)
+	}
+
+	log.Info("Bindings sent to failover partner", "count", count)
+
+	ticker := time.NewTicker(peer.Heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if !send(failoverMessage{Type: failoverHeartbeat}) {
+				return
+			}
+		case msg := <-peer.updates:
+			if !send(msg) {
+				return
+			}
+		}
+	}
+}
+
+func (peer *FailoverPeer) read(conn net.Conn, decoder *json.Decoder) error {
+	for {
+		conn.SetReadDeadline(time.Now().Add(peer.Takeover))
+
+		var msg failoverMessage
+
+		if err := decoder.Decode(&msg); err != nil {
+			return err
+		}
+
+		atomic.StoreInt64(&peer.lastSeen, time.Now().UnixNano())
+
+		switch msg.Type {
+		case failoverBinding:
+			pool := peer.pools.Find(msg.Pool)
+
+			if pool == nil || msg.Record == nil {
+				peer.Logger.Debug("Ignoring binding of unknown pool", "pool", msg.Pool)
+				break
+			}
+
+			pool.Do(func() { pool.applyBinding(msg.Record) })
+		}
+	}
+}
+
+// send queues binding update, dropped while partner is disconnected as whole
+// state is sent on reconnect
+func (peer *FailoverPeer) send(msg failoverMessage) {
+	if atomic.LoadInt32(&peer.connected) == 0 {
+		return
+	}
+
+	select {
+	case peer.updates <- msg:
+	default:
+		peer.Logger.Warn("Failover update queue full, resynchronizing")
+
+		peer.mutex.Lock()
+		if peer.conn != nil {
+			peer.conn.Close()
+		}
+		peer.mutex.Unlock()
+	}
+}
+
+// WrapStore returns lease store passing binding changes of pool to partner
+func (peer *FailoverPeer) WrapStore(pool string, store LeaseStore) LeaseStore {
+	return &replicatedLeaseStore{
+		LeaseStore: store,
+		pool:       pool,
+		peer:       peer,
+	}
+}
+
+type replicatedLeaseStore struct {
+	LeaseStore
+	pool string
+	peer *FailoverPeer
+}
+
+func (store *replicatedLeaseStore) Put(lease *Lease) error {
+	// offers are local, partner learns about binding once acknowledged
+	if lease.State != LeaseReserved {
+		record := newLeaseRecord(lease)
+		store.peer.send(failoverMessage{Type: failoverBinding, Pool: store.pool, Record: &record})
+	}
+
+	return store.LeaseStore.Put(lease)
+}
+
+func (store *replicatedLeaseStore) Remove(address net.IP) error {
+	store.peer.send(failoverMessage{
+		Type: failoverBinding,
+		Pool: store.pool,
+		Record: &leaseRecord{
+			Op:      leaseRecordRemove,
+			Address: address.String(),
+		},
+	})
+
+	return store.LeaseStore.Remove(address)
+}
+
+// localStore strips replication, for changes that came from partner
+func localStore(store LeaseStore) LeaseStore {
+	if replicated, ok := store.(*replicatedLeaseStore); ok {
+		return replicated.LeaseStore
+	}
+
+	return store
+}
+
+// bindingRecords must be called from pool's Run goroutine
+func (pool *Pool) bindingRecords() []*leaseRecord {
+	records := make([]*leaseRecord, 0, len(pool.Leases))
+
+	for _, lease := range pool.Leases {
+		if lease.State != LeaseReserved {
+			record := newLeaseRecord(lease)
+			records = append(records, &record)
+		}
+	}
+
+	return records
+}
+
+// applyBinding stores change made by partner, must be called from pool's
+// Run goroutine. Conflicting bindings of different clients, possible only
+// after both partners took over, are resolved in favour of longer lease.
+func (pool *Pool) applyBinding(record *leaseRecord) {
+	address := net.ParseIP(record.Address)
+
+	idx, err := pool.indexFromAddress(address)
+	if err != nil {
+		pool.Logger.Warn("Ignoring partner binding outside of pool", "address", record.Address)
+		return
+	}
+
+	existing, found := pool.Leases[idx]
+
+	if record.Op == leaseRecordRemove {
+		// own offers are unknown to partner
+		if found && existing.State != LeaseReserved {
+			pool.setLease(idx, nil)
+			localStore(pool.Store).Remove(existing.Address)
+		}
+		return
+	}
+
+	lease, err := record.lease()
+	if err != nil {
+		pool.Logger.Warn("Invalid partner binding", "address", record.Address, "error", err)
+		return
+	}
+
+	if _, valid := pool.leaseIndex(lease); !valid {
+		pool.Logger.Warn("Ignoring partner binding outside of pool range", "address", lease.Address)
+		return
+	}
+
+	if found && existing.State != LeaseReserved && existing.State != LeaseExpired && !pool.sameClient(&existing.ID, &lease.ID) {
+		if existing.State == LeaseStatic || (lease.State != LeaseStatic && existing.Expires.After(lease.Expires)) {
+			pool.Logger.Warn("Conflicting partner binding, keeping local", "address", lease.Address)
+			return
+		}
+
+		pool.Logger.Warn("Conflicting partner binding, replacing local", "address", lease.Address)
+	}
+
+	// client may have our offer pending or old binding remembered elsewhere
+	for _, i := range pool.clientLeases(&lease.ID) {
+		if other := pool.Leases[i]; i != idx && (other.State == LeaseReserved || other.State == LeaseExpired) {
+			pool.setLease(i, nil)
+			localStore(pool.Store).Remove(other.Address)
+		}
+	}
+
+	pool.setLease(idx, lease)
+
+	if err := localStore(pool.Store).Put(lease); err != nil {
+		pool.Logger.Error("Unable to store lease", "address", lease.Address, "error", err)
+	}
+}
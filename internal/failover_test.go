@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"encoding/json"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestPeer(t *testing.T, role string, secret string) *FailoverPeer {
+	peer, err := NewFailoverPeer(&FailoverConfig{
+		Role:   role,
+		Listen: "127.0.0.1:0",
+		Peer:   "127.0.0.1:0",
+		Secret: secret,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return peer
+}
+
+// connectPeers returns both ends of loopback TCP connection
+func connectPeers(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	return client, server
+}
+
+func handshake(peer *FailoverPeer, conn net.Conn) error {
+	return peer.handshake(conn, json.NewEncoder(conn), json.NewDecoder(conn))
+}
+
+func TestFailoverHandshake(t *testing.T) {
+	tests := []struct {
+		name      string
+		primary   string
+		secondary string
+		ok        bool
+	}{
+		{"same secret", "s3cret", "s3cret", true},
+		{"wrong secret", "guess", "s3cret", false},
+	}
+
+	for _, test := range tests {
+		primary := newTestPeer(t, "primary", test.primary)
+		secondary := newTestPeer(t, "secondary", test.secondary)
+		client, server := connectPeers(t)
+
+		result := make(chan error)
+		go func() { result <- handshake(secondary, server) }()
+
+		primaryErr := handshake(primary, client)
+		secondaryErr := <-result
+
+		if (primaryErr == nil) != test.ok || (secondaryErr == nil) != test.ok {
+			t.Errorf("%s: primary %v, secondary %v", test.name, primaryErr, secondaryErr)
+		}
+	}
+}
+
+func TestFailoverRejectsWrongSecret(t *testing.T) {
+	secondary := newTestPeer(t, "secondary", "s3cret")
+	attacker := newTestPeer(t, "primary", "guess")
+	client, server := connectPeers(t)
+
+	seen := atomic.LoadInt64(&secondary.lastSeen)
+	done := make(chan struct{})
+
+	go func() {
+		secondary.serve(server)
+		close(done)
+	}()
+
+	if err := handshake(attacker, client); err == nil {
+		t.Error("Handshake with wrong secret succeeded")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Connection with wrong secret not dropped")
+	}
+
+	if secondary.conn != nil || atomic.LoadInt64(&secondary.lastSeen) != seen {
+		t.Error("Rejected partner accepted")
+	}
+
+	// nothing else is sent to rejected partner
+	client.SetReadDeadline(time.Now().Add(time.Second))
+
+	if n, err := client.Read(make([]byte, 1)); n != 0 || err == nil {
+		t.Errorf("Rejected partner received data: %d, %v", n, err)
+	}
+}
+
+func TestFailoverRequiresSecret(t *testing.T) {
+	if _, err := NewFailoverPeer(&FailoverConfig{Role: "secondary", Listen: "127.0.0.1:0"}); err == nil {
+		t.Error("Failover without secret accepted")
+	}
+}
@@ -0,0 +1,179 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// StaticHost is a fixed address reservation for single client
+type StaticHost struct {
+	Name     string
+	Mac      net.HardwareAddr
+	ClientID []uint8
+	Address  net.IP
+	Hostname string
+	Lifetime time.Duration
+	Agents   AgentIDMatcher
+	Options  DHCPOptions
+}
+
+func newStaticHost(name string, conf *HostConfig) (*StaticHost, error) {
+	host := &StaticHost{
+		Name:     name,
+		Hostname: conf.Hostname,
+	}
+
+	if conf.CircuitID != "" {
+		host.Agents.CircuitIDs = []string{conf.CircuitID}
+	}
+
+	if conf.RemoteID != "" {
+		host.Agents.RemoteIDs = []string{conf.RemoteID}
+	}
+
+	if conf.Mac == "" && conf.ClientID == "" && host.Agents.Empty() {
+		return nil, errors.New("One of mac, client_id, circuit_id or remote_id is required")
+	}
+
+	if conf.Mac != "" {
+		mac, err := net.ParseMAC(conf.Mac)
+		if err != nil {
+			return nil, err
+		}
+
+		host.Mac = mac
+	}
+
+	if conf.ClientID != "" {
+		id, err := parseHexBytes(conf.ClientID)
+		if err != nil {
+			return nil, err
+		}
+
+		host.ClientID = id
+	}
+
+	if host.Address = net.ParseIP(conf.Address).To4(); host.Address == nil {
+		return nil, errors.New("Invalid IPv4 address")
+	}
+
+	lifetime, err := parseOptionalDuration("lifetime", conf.Lifetime)
+	if err != nil {
+		return nil, err
+	}
+
+	host.Lifetime = lifetime
+
+	options, err := BuildDHCPOptions(&conf.Options)
+	if err != nil {
+		return nil, fmt.Errorf("options: %v", err)
+	}
+
+	if len(host.Hostname) > maxOptionLength {
+		return nil, fmt.Errorf("hostname: longer than %d bytes", maxOptionLength)
+	}
+
+	if host.Hostname != "" {
+		options[HostNameOptionCode] = &StringDHCPOption{
+			Value: host.Hostname,
+		}
+	}
+
+	host.Options = options
+
+	return host, nil
+}
+
+// parseHexBytes accepts hex string with optional ':' or '-' separators
+func parseHexBytes(str string) ([]byte, error) {
+	str = strings.Replace(str, ":", "", -1)
+	str = strings.Replace(str, "-", "", -1)
+
+	return hex.DecodeString(str)
+}
+
+func (host *StaticHost) matches(msg *DHCPMessage) bool {
+	if !host.Agents.Matches(msg) {
+		return false
+	}
+
+	if len(host.ClientID) > 0 {
+		return bytes.Equal(host.ClientID, msg.ClientID())
+	}
+
+	if len(host.Mac) > 0 {
+		return bytes.Equal(host.Mac, msg.ClientHwAddr)
+	}
+
+	// reservation for whoever is connected to given relay agent port
+	return true
+}
+
+// owns reports whether lease of client may belong to reservation, clients
+// of relay agent port only reservations can't be told from lease
+func (host *StaticHost) owns(id *ClientIdentifier) bool {
+	if len(host.ClientID) > 0 {
+		return bytes.Equal(host.ClientID, id.ID)
+	}
+
+	return len(host.Mac) > 0 && bytes.Equal(host.Mac, id.Mac)
+}
+
+// precedence ranks matching reservations, lower wins: client identifier,
+// then relay agent port, then hardware address
+func (host *StaticHost) precedence() int {
+	switch {
+	case len(host.ClientID) > 0:
+		return 0
+	case !host.Agents.Empty():
+		return 1
+	}
+
+	return 2
+}
+
+// findHost returns reservation of client, by precedence and then name when
+// more of them match
+func (pool *Pool) findHost(msg *DHCPMessage) (uint32, *StaticHost) {
+	var found *StaticHost
+	var foundIdx uint32
+
+	for idx, host := range pool.Hosts {
+		if !host.matches(msg) {
+			continue
+		}
+
+		if found == nil || host.precedence() < found.precedence() ||
+			(host.precedence() == found.precedence() && host.Name < found.Name) {
+			found = host
+			foundIdx = idx
+		}
+	}
+
+	return foundIdx, found
+}
+
+// configuredOptions adds subnet mask plus pool and host options to reply
+func (pool *Pool) configuredOptions(reply *DHCPMessage, host *StaticHost) {
+	mask := pool.Network.Mask
+
+	reply.Options[SubnetMaskOptionCode] = &IPDHCPOption{
+		Value: []net.IP{
+			net.IPv4(mask[0], mask[1], mask[2], mask[3]),
+		},
+	}
+
+	options := pool.Options
+	if host != nil {
+		options = options.Merge(host.Options)
+	}
+
+	for code, opt := range options {
+		reply.Options[code] = opt
+	}
+}
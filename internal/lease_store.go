@@ -0,0 +1,361 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// LeaseStore persists pool bindings so they survive restarts
+type LeaseStore interface {
+	Leases() []*Lease
+	Put(lease *Lease) error
+	Remove(address net.IP) error
+	// Compact may rewrite storage to contain only given leases
+	Compact(leases LeaseMap) error
+	Close() error
+}
+
+type leaseRecord struct {
+	Op       string    `json:"op"`
+	Address  string    `json:"address"`
+	State    int       `json:"state,omitempty"`
+	ClientID string    `json:"client_id,omitempty"`
+	Mac      string    `json:"mac,omitempty"`
+	IAID     uint32    `json:"iaid,omitempty"`
+	Expires  time.Time `json:"expires"`
+}
+
+const (
+	leaseRecordPut    = "put"
+	leaseRecordRemove = "remove"
+)
+
+func NewLeaseStore(conf *LeaseStoreConfig, name string) (LeaseStore, error) {
+	switch conf.Type {
+	case "", "file":
+		dir := conf.Directory
+
+		if dir == "" {
+			dir = "."
+		}
+
+		interval := time.Hour
+
+		if conf.CompactInterval != "" {
+			var err error
+
+			if interval, err = time.ParseDuration(conf.CompactInterval); err != nil {
+				return nil, err
+			}
+		}
+
+		return OpenFileLeaseStore(filepath.Join(dir, name+".leases"), interval)
+
+	case "memory":
+		return &MemoryLeaseStore{}, nil
+	}
+
+	return nil, fmt.Errorf("Unknown lease store type: %s", conf.Type)
+}
+
+// MemoryLeaseStore keeps nothing, bindings are lost on restart
+type MemoryLeaseStore struct{}
+
+func (store *MemoryLeaseStore) Leases() []*Lease {
+	return nil
+}
+
+func (store *MemoryLeaseStore) Put(lease *Lease) error {
+	return nil
+}
+
+func (store *MemoryLeaseStore) Remove(address net.IP) error {
+	return nil
+}
+
+func (store *MemoryLeaseStore) Compact(leases LeaseMap) error {
+	return nil
+}
+
+func (store *MemoryLeaseStore) Close() error {
+	return nil
+}
+
+// FileLeaseStore is an append-only journal of lease changes,
+// periodically rewritten to contain only live bindings
+type FileLeaseStore struct {
+	path      string
+	file      *os.File
+	leases    []*Lease
+	interval  time.Duration
+	compacted time.Time
+	dirty     bool
+}
+
+func OpenFileLeaseStore(path string, interval time.Duration) (*FileLeaseStore, error) {
+	store := &FileLeaseStore{
+		path:      path,
+		interval:  interval,
+		compacted: time.Now(),
+	}
+
+	valid, corrupted, err := store.replay()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if corrupted {
+		// records appended after corrupted one would be ignored by next replay
+		if err := file.Truncate(valid); err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		Log.Warn("Lease journal truncated after last valid record", "path", path, "size", valid)
+	} else if info.Size() < valid {
+		// last record is missing line end, next one mustn't be glued to it
+		if _, err := file.Write([]byte{'\n'}); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	store.file = file
+
+	return store, nil
+}
+
+// replay loads leases from journal, returning length of its valid part
+// including line end and whether corrupted records follow it
+func (store *FileLeaseStore) replay() (int64, bool, error) {
+	file, err := os.Open(store.path)
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	defer file.Close()
+
+	leases := make(map[string]*Lease)
+	order := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	line := 0
+	valid := int64(0)
+	corrupted := false
+
+	for scanner.Scan() {
+		line++
+
+		var record leaseRecord
+
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// most likely a write interrupted by crash, nothing after it can be trusted
+			Log.Warn("Lease journal corrupted, ignoring rest", "path", store.path, "line", line, "error", err)
+			corrupted = true
+			break
+		}
+
+		valid += int64(len(scanner.Bytes())) + 1
+
+		switch record.Op {
+		case leaseRecordPut:
+			lease, err := record.lease()
+			if err != nil {
+				Log.Warn("Invalid lease journal record", "path", store.path, "line", line, "error", err)
+				continue
+			}
+
+			if _, exists := leases[record.Address]; !exists {
+				order = append(order, record.Address)
+			}
+
+			leases[record.Address] = lease
+
+		case leaseRecordRemove:
+			delete(leases, record.Address)
+		}
+	}
+
+	if err := scanner.Err(); err == bufio.ErrTooLong {
+		// no record is that long, garbage rather than a reason not to start
+		Log.Warn("Lease journal corrupted, ignoring rest", "path", store.path, "line", line+1, "error", err)
+		corrupted = true
+	} else if err != nil {
+		return 0, false, err
+	}
+
+	for _, address := range order {
+		if lease, found := leases[address]; found {
+			store.leases = append(store.leases, lease)
+		}
+	}
+
+	// journal holds history that compaction would drop
+	store.dirty = line > len(store.leases)
+
+	return valid, corrupted, nil
+}
+
+// Leases returns bindings replayed from journal when store was opened
+func (store *FileLeaseStore) Leases() []*Lease {
+	return store.leases
+}
+
+func (store *FileLeaseStore) Put(lease *Lease) error {
+	return store.write(newLeaseRecord(lease))
+}
+
+func (store *FileLeaseStore) Remove(address net.IP) error {
+	return store.write(leaseRecord{
+		Op:      leaseRecordRemove,
+		Address: address.String(),
+	})
+}
+
+func (store *FileLeaseStore) write(record leaseRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if _, err := store.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	store.dirty = true
+
+	// binding must be on disk before client hears about it
+	return store.file.Sync()
+}
+
+// Compact replaces journal with a snapshot of given leases,
+// at most once per compaction interval
+func (store *FileLeaseStore) Compact(leases LeaseMap) error {
+	if !store.dirty || time.Since(store.compacted) < store.interval {
+		return nil
+	}
+
+	tmpPath := store.path + ".tmp"
+
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	// half written snapshot must not be left behind
+	discard := func(err error) error {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	writer := bufio.NewWriter(tmp)
+
+	for _, lease := range leases {
+		data, err := json.Marshal(newLeaseRecord(lease))
+		if err != nil {
+			return discard(err)
+		}
+
+		writer.Write(data)
+		writer.WriteByte('\n')
+	}
+
+	if err := writer.Flush(); err != nil {
+		return discard(err)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		return discard(err)
+	}
+
+	if err := os.Rename(tmpPath, store.path); err != nil {
+		return discard(err)
+	}
+
+	// tmp now is the journal, keep appending to it
+	if _, err := tmp.Seek(0, io.SeekEnd); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	store.file.Close()
+	store.file = tmp
+	store.compacted = time.Now()
+	store.dirty = false
+
+	return nil
+}
+
+func (store *FileLeaseStore) Close() error {
+	return store.file.Close()
+}
+
+func newLeaseRecord(lease *Lease) leaseRecord {
+	record := leaseRecord{
+		Op:       leaseRecordPut,
+		Address:  lease.Address.String(),
+		State:    int(lease.State),
+		ClientID: hex.EncodeToString(lease.ID.ID),
+		IAID:     lease.IAID,
+		Expires:  lease.Expires,
+	}
+
+	if len(lease.ID.Mac) > 0 {
+		record.Mac = lease.ID.Mac.String()
+	}
+
+	return record
+}
+
+func (record *leaseRecord) lease() (*Lease, error) {
+	address := net.ParseIP(record.Address)
+	if address == nil {
+		return nil, errors.New("Invalid lease address")
+	}
+
+	id, err := hex.DecodeString(record.ClientID)
+	if err != nil {
+		return nil, err
+	}
+
+	lease := &Lease{
+		Address: address,
+		State:   LeaseState(record.State),
+		IAID:    record.IAID,
+		Expires: record.Expires,
+	}
+
+	if len(id) > 0 {
+		lease.ID.ID = id
+	}
+
+	if record.Mac != "" {
+		if lease.ID.Mac, err = net.ParseMAC(record.Mac); err != nil {
+			return nil, err
+		}
+	}
+
+	return lease, nil
+}
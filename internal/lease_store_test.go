@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileLeaseStoreTruncatesLongCorruptLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.json")
+	record := `{"op":"put","address":"10.0.0.10","state":1,"mac":"08:00:27:00:00:01","expires":"2030-01-01T00:00:00Z"}` + "\n"
+	garbage := bytes.Repeat([]byte{'x'}, 100*1024)
+
+	data := append([]byte(record), garbage...)
+	data = append(data, '\n')
+	data = append(data, record...)
+
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := OpenFileLeaseStore(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if leases := store.Leases(); len(leases) != 1 || !leases[0].Address.Equal(net.IPv4(10, 0, 0, 10)) {
+		t.Errorf("Replayed %v", leases)
+	}
+
+	if info, err := os.Stat(path); err != nil || info.Size() != int64(len(record)) {
+		t.Errorf("Journal not truncated to last valid record: %v, %v", info.Size(), err)
+	}
+}
+
+func TestFileLeaseStoreCompactRemovesTmpOnFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.json")
+
+	store, err := OpenFileLeaseStore(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	lease := &Lease{Address: net.IPv4(10, 0, 0, 10), State: LeaseInUse, ID: testClient(1), Expires: time.Now().Add(time.Hour)}
+
+	if err := store.Put(lease); err != nil {
+		t.Fatal(err)
+	}
+
+	// journal can't be replaced by non-empty directory
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(path, "blocker"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Compact(LeaseMap{10: lease}); err == nil {
+		t.Fatal("Compaction succeeded")
+	}
+
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("Temporary snapshot left behind: %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// RFC 2131 4.4.5 defaults, as fraction of lease time
+	defaultRenewal   = 0.5
+	defaultRebinding = 0.875
+)
+
+// LeaseClass overrides lease times for clients whose vendor class
+// identifier (option 60) starts with VendorClass, zero values inherit pool's
+type LeaseClass struct {
+	Name        string
+	VendorClass string
+	Lifetime    time.Duration
+	MinLifetime time.Duration
+	MaxLifetime time.Duration
+}
+
+// parseOptionalDuration returns zero for empty value
+func parseOptionalDuration(key string, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", key, err)
+	}
+
+	return duration, nil
+}
+
+// renewalTimes applies defaults to configured T1 and T2 fractions and checks their order
+func renewalTimes(renewal float64, rebinding float64) (float64, float64, error) {
+	if renewal == 0 {
+		renewal = defaultRenewal
+	}
+	if rebinding == 0 {
+		rebinding = defaultRebinding
+	}
+
+	if renewal <= 0 || renewal >= rebinding || rebinding >= 1 {
+		return 0, 0, fmt.Errorf("Renewal %g and rebinding %g must satisfy 0 < renewal < rebinding < 1", renewal, rebinding)
+	}
+
+	return renewal, rebinding, nil
+}
+
+func newLeaseClasses(classes map[string]ClassConfig) ([]*LeaseClass, error) {
+	result := make([]*LeaseClass, 0, len(classes))
+
+	for name, conf := range classes {
+		class := &LeaseClass{
+			Name:        name,
+			VendorClass: conf.VendorClass,
+		}
+
+		var err error
+
+		if class.Lifetime, err = parseOptionalDuration("lifetime", conf.Lifetime); err != nil {
+			return nil, fmt.Errorf("class %s: %v", name, err)
+		}
+
+		if class.MinLifetime, err = parseOptionalDuration("min_lifetime", conf.MinLifetime); err != nil {
+			return nil, fmt.Errorf("class %s: %v", name, err)
+		}
+
+		if class.MaxLifetime, err = parseOptionalDuration("max_lifetime", conf.MaxLifetime); err != nil {
+			return nil, fmt.Errorf("class %s: %v", name, err)
+		}
+
+		result = append(result, class)
+	}
+
+	// longest prefix wins, name breaks ties
+	sort.Slice(result, func(i, j int) bool {
+		if len(result[i].VendorClass) != len(result[j].VendorClass) {
+			return len(result[i].VendorClass) > len(result[j].VendorClass)
+		}
+
+		return result[i].Name < result[j].Name
+	})
+
+	return result, nil
+}
+
+func (pool *Pool) findClass(msg *DHCPMessage) *LeaseClass {
+	vendorClass := msg.VendorClass()
+
+	if vendorClass == "" {
+		return nil
+	}
+
+	for _, class := range pool.Classes {
+		if strings.HasPrefix(vendorClass, class.VendorClass) {
+			return class
+		}
+	}
+
+	return nil
+}
+
+// leaseTime picks lifetime for client: static host's if set, otherwise
+// time requested by client (option 51) bounded by its class or pool limits
+func (pool *Pool) leaseTime(msg *DHCPMessage, host *StaticHost) time.Duration {
+	if host != nil && host.Lifetime > 0 {
+		return host.Lifetime
+	}
+
+	lifetime, min, max := pool.Lifetime, pool.MinLifetime, pool.MaxLifetime
+
+	if class := pool.findClass(msg); class != nil {
+		if class.Lifetime > 0 {
+			lifetime = class.Lifetime
+		}
+
+		if class.MinLifetime > 0 {
+			min = class.MinLifetime
+		}
+
+		if class.MaxLifetime > 0 {
+			max = class.MaxLifetime
+		}
+	}
+
+	if requested := msg.RequestedLeaseTime(); requested > 0 {
+		lifetime = requested
+	}
+
+	if min > 0 && lifetime < min {
+		lifetime = min
+	}
+
+	if max > 0 && lifetime > max {
+		lifetime = max
+	}
+
+	return lifetime
+}
+
+// addLeaseTimeOptions sets lease time along with renewal (T1) and rebinding (T2) times
+func (pool *Pool) addLeaseTimeOptions(reply *DHCPMessage, lifetime time.Duration) {
+	reply.Options[IPAddressLeaseTimeOptionCode] = &DurationDHCPOption{
+		Value: lifetime,
+	}
+	reply.Options[RenewalTimeValueOptionCode] = &DurationDHCPOption{
+		Value: time.Duration(float64(lifetime) * pool.Renewal),
+	}
+	reply.Options[RebindingTimeValueOptionCode] = &DurationDHCPOption{
+		Value: time.Duration(float64(lifetime) * pool.Rebinding),
+	}
+}
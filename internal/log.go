@@ -0,0 +1,373 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"log/syslog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type PacketDump int
+
+const (
+	DumpNone PacketDump = iota
+	// header fields only
+	DumpSummary PacketDump = iota
+	// header and all options
+	DumpFull PacketDump = iota
+)
+
+var (
+	logLevel = new(slog.LevelVar)
+	// handler loggers write to, swapped by SetupLogging
+	logHandler atomic.Pointer[slog.Handler]
+	// PacketDump verbosity
+	packetDump atomic.Int32
+	// connection of syslog target, kept across reloads, guarded by logSetup
+	syslogOut *syslogOutput
+	logSetup  sync.Mutex
+)
+
+// Log is used by whole server. It's never replaced, loggers derived from it
+// follow handler set by SetupLogging, also on configuration reload.
+var Log = slog.New(&reloadableHandler{})
+
+func init() {
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})
+	logHandler.Store(&handler)
+}
+
+func parseLogLevel(name string) (slog.Level, error) {
+	switch name {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+
+	return slog.LevelInfo, fmt.Errorf("Unknown log level: %s", name)
+}
+
+func parsePacketDump(name string) (PacketDump, error) {
+	switch name {
+	case "", "none":
+		return DumpNone, nil
+	case "summary":
+		return DumpSummary, nil
+	case "full":
+		return DumpFull, nil
+	}
+
+	return DumpNone, fmt.Errorf("Unknown packet dump verbosity: %s", name)
+}
+
+// SetupLogging switches Log to configured level, target and format, safe to
+// call while other goroutines log
+func SetupLogging(conf *LogConfig) error {
+	level, err := parseLogLevel(conf.Level)
+	if err != nil {
+		return err
+	}
+
+	dump, err := parsePacketDump(conf.Dump)
+	if err != nil {
+		return err
+	}
+
+	logSetup.Lock()
+	defer logSetup.Unlock()
+
+	options := &slog.HandlerOptions{Level: logLevel}
+
+	var out io.Writer
+	var output *syslogOutput
+
+	switch conf.Target {
+	case "", "stderr":
+		out = os.Stderr
+	case "stdout":
+		out = os.Stdout
+	case "syslog":
+		if output = syslogOut; output == nil {
+			// journald listens on syslog socket as well
+			writer, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, "godhcpd")
+			if err != nil {
+				return err
+			}
+
+			output = &syslogOutput{writer: writer}
+		}
+
+		out = &output.buffer
+
+		// syslog stamps messages itself
+		options.ReplaceAttr = func(groups []string, attr slog.Attr) slog.Attr {
+			if len(groups) == 0 && attr.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return attr
+		}
+	default:
+		return fmt.Errorf("Unknown log target: %s", conf.Target)
+	}
+
+	var handler slog.Handler
+
+	switch conf.Format {
+	case "", "text", "logfmt":
+		handler = slog.NewTextHandler(out, options)
+	case "json":
+		handler = slog.NewJSONHandler(out, options)
+	default:
+		if output != nil && output != syslogOut {
+			output.close()
+		}
+
+		return fmt.Errorf("Unknown log format: %s", conf.Format)
+	}
+
+	if output != nil {
+		handler = &syslogHandler{handler, output}
+	}
+
+	logLevel.Set(level)
+	logHandler.Store(&handler)
+	packetDump.Store(int32(dump))
+
+	// no longer logging to syslog
+	if syslogOut != nil && syslogOut != output {
+		syslogOut.close()
+	}
+
+	syslogOut = output
+
+	return nil
+}
+
+// reloadableHandler passes records to current handler of logHandler, with
+// attributes and groups of derived loggers applied on top of it
+type reloadableHandler struct {
+	// applied in order, either attributes or group
+	derive []func(slog.Handler) slog.Handler
+	cache  atomic.Pointer[derivedHandler]
+}
+
+// derivedHandler is base handler with derive applied
+type derivedHandler struct {
+	base    *slog.Handler
+	handler slog.Handler
+}
+
+func (h *reloadableHandler) current() slog.Handler {
+	base := logHandler.Load()
+
+	if cached := h.cache.Load(); cached != nil && cached.base == base {
+		return cached.handler
+	}
+
+	handler := *base
+
+	for _, derive := range h.derive {
+		handler = derive(handler)
+	}
+
+	h.cache.Store(&derivedHandler{base, handler})
+
+	return handler
+}
+
+func (h *reloadableHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.current().Enabled(ctx, level)
+}
+
+func (h *reloadableHandler) Handle(ctx context.Context, record slog.Record) error {
+	return h.current().Handle(ctx, record)
+}
+
+func (h *reloadableHandler) with(derive func(slog.Handler) slog.Handler) slog.Handler {
+	result := &reloadableHandler{
+		derive: make([]func(slog.Handler) slog.Handler, 0, len(h.derive)+1),
+	}
+
+	result.derive = append(append(result.derive, h.derive...), derive)
+
+	return result
+}
+
+func (h *reloadableHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler {
+		return handler.WithAttrs(attrs)
+	})
+}
+
+func (h *reloadableHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler {
+		return handler.WithGroup(name)
+	})
+}
+
+// syslogOutput is connection to syslog with buffer handlers format records into
+type syslogOutput struct {
+	mutex  sync.Mutex
+	writer *syslog.Writer
+	buffer bytes.Buffer
+}
+
+// close disconnects from syslog, records still being logged through
+// replaced handler are dropped
+func (out *syslogOutput) close() {
+	out.mutex.Lock()
+	defer out.mutex.Unlock()
+
+	out.writer.Close()
+	out.writer = nil
+}
+
+// syslogHandler formats records with wrapped handler into buffer, then passes
+// them to syslog with priority matching record level
+type syslogHandler struct {
+	handler slog.Handler
+	out     *syslogOutput
+}
+
+func (h *syslogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler.Enabled(ctx, level)
+}
+
+func (h *syslogHandler) Handle(ctx context.Context, record slog.Record) error {
+	out := h.out
+
+	out.mutex.Lock()
+	defer out.mutex.Unlock()
+
+	// writer would reconnect once closed
+	if out.writer == nil {
+		return nil
+	}
+
+	out.buffer.Reset()
+
+	if err := h.handler.Handle(ctx, record); err != nil {
+		return err
+	}
+
+	line := strings.TrimSuffix(out.buffer.String(), "\n")
+
+	switch {
+	case record.Level >= slog.LevelError:
+		return out.writer.Err(line)
+	case record.Level >= slog.LevelWarn:
+		return out.writer.Warning(line)
+	case record.Level >= slog.LevelInfo:
+		return out.writer.Info(line)
+	}
+
+	return out.writer.Debug(line)
+}
+
+func (h *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &syslogHandler{h.handler.WithAttrs(attrs), h.out}
+}
+
+func (h *syslogHandler) WithGroup(name string) slog.Handler {
+	return &syslogHandler{h.handler.WithGroup(name), h.out}
+}
+
+// messageLog returns logger with fields identifying DHCP message and its client
+func messageLog(log *slog.Logger, msg *DirectedDHCPMessage) *slog.Logger {
+	return log.With(
+		"interface", interfaceName(msg.Interface),
+		"xid", fmt.Sprintf("0x%08x", msg.Message.TransactionID),
+		"chaddr", msg.Message.ClientHwAddr.String(),
+		"type", msg.Message.Type().String(),
+	)
+}
+
+// messageLog6 is messageLog for DHCPv6, client is identified by DUID
+func messageLog6(log *slog.Logger, msg *DirectedDHCPv6Message) *slog.Logger {
+	return log.With(
+		"interface", interfaceName(msg.Interface),
+		"xid", fmt.Sprintf("0x%06x", msg.Message.TransactionID),
+		"duid", fmt.Sprintf("%x", msg.Message.ClientDUID()),
+		"type", msg.Message.Type.String(),
+	)
+}
+
+// DumpDHCPMessage logs message contents according to configured dump verbosity
+func DumpDHCPMessage(log *slog.Logger, direction string, msg *DHCPMessage) {
+	dump := PacketDump(packetDump.Load())
+
+	if dump == DumpNone {
+		return
+	}
+
+	attrs := []interface{}{
+		"op", int(msg.BootpOperation),
+		"xid", fmt.Sprintf("0x%08x", msg.TransactionID),
+		"flags", fmt.Sprintf("0x%04x", uint16(msg.Flags)),
+		"chaddr", msg.ClientHwAddr.String(),
+		"ciaddr", msg.ClientIP.String(),
+		"yiaddr", msg.YourIP.String(),
+		"siaddr", msg.ServerIP.String(),
+		"giaddr", msg.RelayAgentIP.String(),
+		"type", msg.Type().String(),
+	}
+
+	if dump == DumpFull {
+		codes := make([]int, 0, len(msg.Options))
+
+		for code := range msg.Options {
+			codes = append(codes, int(code))
+		}
+
+		sort.Ints(codes)
+
+		options := make([]interface{}, 0, len(codes))
+
+		for _, code := range codes {
+			options = append(options, slog.String(fmt.Sprint(code), fmt.Sprint(msg.Options[DHCPOptionCode(code)].Data())))
+		}
+
+		attrs = append(attrs, slog.Group("options", options...))
+	}
+
+	log.Info(direction+" DHCP message", attrs...)
+}
+
+// DumpDHCPv6Message logs message contents according to configured dump verbosity
+func DumpDHCPv6Message(log *slog.Logger, direction string, msg *DHCPv6Message) {
+	dump := PacketDump(packetDump.Load())
+
+	if dump == DumpNone {
+		return
+	}
+
+	attrs := []interface{}{
+		"xid", fmt.Sprintf("0x%06x", msg.TransactionID),
+		"type", msg.Type.String(),
+	}
+
+	if dump == DumpFull {
+		options := make([]interface{}, 0, len(msg.Options))
+
+		for i, opt := range msg.Options {
+			// options may repeat, index keeps keys unique
+			options = append(options, slog.String(fmt.Sprintf("%d.%d", i, opt.Code), fmt.Sprintf("%x", opt.Data)))
+		}
+
+		attrs = append(attrs, slog.Group("options", options...))
+	}
+
+	log.Info(direction+" DHCPv6 message", attrs...)
+}
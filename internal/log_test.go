@@ -0,0 +1,42 @@
+package internal
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+)
+
+func TestSetupLoggingReusesSyslog(t *testing.T) {
+	if err := SetupLogging(&LogConfig{Level: "error", Target: "syslog"}); err != nil {
+		t.Skip("Syslog not available:", err)
+	}
+
+	t.Cleanup(func() { SetupLogging(&LogConfig{Level: "error"}) })
+
+	first := syslogOut
+	writer := first.writer
+
+	if err := SetupLogging(&LogConfig{Level: "error", Target: "syslog", Format: "json"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if syslogOut != first || first.writer != writer {
+		t.Error("Reload opened new syslog connection")
+	}
+
+	if err := SetupLogging(&LogConfig{Level: "error", Target: "stderr"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if syslogOut != nil || first.writer != nil {
+		t.Error("Syslog connection not closed")
+	}
+
+	// records logged through replaced handler mustn't reconnect
+	handler := &syslogHandler{nil, first}
+
+	if err := handler.Handle(context.Background(), slog.Record{}); err != nil || first.writer != nil {
+		t.Errorf("Closed syslog output reconnected: %v", err)
+	}
+
+}
@@ -0,0 +1,172 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// counterVec is Prometheus counter with labels, safe for concurrent use
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mutex  sync.Mutex
+	values map[string]uint64
+}
+
+var (
+	messagesReceived   = newCounterVec("godhcpd_messages_received_total", "DHCP messages received.", "type", "interface")
+	messagesSent       = newCounterVec("godhcpd_messages_sent_total", "DHCP messages sent.", "type", "interface")
+	parseErrors        = newCounterVec("godhcpd_parse_errors_total", "Received packets that couldn't be parsed as DHCP message.", "interface")
+	validationFailures = newCounterVec("godhcpd_validation_failures_total", "DHCP messages rejected by validation.", "pool")
+	leaseExpirations   = newCounterVec("godhcpd_lease_expirations_total", "Leases freed because they expired.", "pool")
+	probeConflicts     = newCounterVec("godhcpd_probe_conflicts_total", "Addresses found in use by probe before offering.", "pool")
+)
+
+func newCounterVec(name string, help string, labels ...string) *counterVec {
+	return &counterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]uint64),
+	}
+}
+
+// Inc increments counter of given label values, in order of counter's labels
+func (counter *counterVec) Inc(values ...string) {
+	var key bytes.Buffer
+
+	for i, label := range counter.labels {
+		if i > 0 {
+			key.WriteByte(',')
+		}
+
+		fmt.Fprintf(&key, "%s=\"%s\"", label, escapeLabelValue(values[i]))
+	}
+
+	counter.mutex.Lock()
+	counter.values[key.String()]++
+	counter.mutex.Unlock()
+}
+
+func (counter *counterVec) write(w io.Writer) {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+
+	keys := make([]string, 0, len(counter.values))
+
+	for key := range counter.values {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", counter.name, counter.help, counter.name)
+
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s{%s} %d\n", counter.name, key, counter.values[key])
+	}
+}
+
+func escapeLabelValue(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+
+	return strings.Replace(value, "\n", `\n`, -1)
+}
+
+func interfaceName(iface *net.Interface) string {
+	if iface == nil {
+		return ""
+	}
+
+	return iface.Name
+}
+
+// MetricsServer serves counters and pool utilization in Prometheus text format on /metrics
+type MetricsServer struct {
+	Pools *PoolSet
+}
+
+func ServeMetrics(listen string, pools *PoolSet) error {
+	return http.ListenAndServe(listen, &MetricsServer{Pools: pools})
+}
+
+func (metrics *MetricsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/metrics" {
+		http.NotFound(w, r)
+		return
+	}
+
+	var buffer bytes.Buffer
+
+	for _, counter := range []*counterVec{messagesReceived, messagesSent, parseErrors, validationFailures, leaseExpirations, probeConflicts} {
+		counter.write(&buffer)
+	}
+
+	metrics.writePools(&buffer)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buffer.Bytes())
+}
+
+// writePools exports gauges of pool address usage, collected inside pools' Run goroutines
+func (metrics *MetricsServer) writePools(w io.Writer) {
+	type poolUsage struct {
+		summary adminPool
+		free    int
+	}
+
+	pools := metrics.Pools.Pools()
+	usage := make([]poolUsage, 0, len(pools))
+
+	for _, pool := range pools {
+		var current poolUsage
+
+		ran := pool.Do(func() {
+			current.summary = pool.summary()
+			current.free = pool.freeCount()
+		})
+
+		if ran {
+			usage = append(usage, current)
+		}
+	}
+
+	fmt.Fprint(w, "# HELP godhcpd_pool_size Addresses in dynamic range of pool, host reservations excluded.\n# TYPE godhcpd_pool_size gauge\n")
+
+	for _, u := range usage {
+		fmt.Fprintf(w, "godhcpd_pool_size{pool=\"%s\"} %d\n", escapeLabelValue(u.summary.Name), u.summary.Size)
+	}
+
+	fmt.Fprint(w, "# HELP godhcpd_pool_free Addresses of dynamic range available for allocation.\n# TYPE godhcpd_pool_free gauge\n")
+
+	for _, u := range usage {
+		fmt.Fprintf(w, "godhcpd_pool_free{pool=\"%s\"} %d\n", escapeLabelValue(u.summary.Name), u.free)
+	}
+
+	fmt.Fprint(w, "# HELP godhcpd_pool_leases Leases of pool by state.\n# TYPE godhcpd_pool_leases gauge\n")
+
+	for _, u := range usage {
+		name := escapeLabelValue(u.summary.Name)
+
+		counts := map[LeaseState]int{
+			LeaseReserved: u.summary.Reserved,
+			LeaseInUse:    u.summary.InUse,
+			LeaseDeclined: u.summary.Declined,
+			LeaseStatic:   u.summary.Static,
+			LeaseExpired:  u.summary.Expired,
+		}
+
+		for _, state := range []LeaseState{LeaseReserved, LeaseInUse, LeaseDeclined, LeaseStatic, LeaseExpired} {
+			fmt.Fprintf(w, "godhcpd_pool_leases{pool=\"%s\",state=\"%s\"} %d\n", name, state, counts[state])
+		}
+	}
+}
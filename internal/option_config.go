@@ -0,0 +1,275 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+type StaticRouteConfig struct {
+	Destination string
+	Router      string
+}
+
+// CustomOptionConfig describes arbitrary option, Type is one of:
+// ip, string, uint8, uint16, duration, hex
+type CustomOptionConfig struct {
+	Code  int
+	Type  string
+	Value interface{}
+}
+
+type OptionsConfig struct {
+	Routers      []string
+	DNSServers   []string `toml:"dns_servers"`
+	DomainName   string   `toml:"domain_name"`
+	NTPServers   []string `toml:"ntp_servers"`
+	MTU          int
+	StaticRoutes []StaticRouteConfig `toml:"static_routes"`
+	Custom       []CustomOptionConfig
+}
+
+// longest value option length byte can describe
+const maxOptionLength = 255
+
+// BuildDHCPOptions encodes configured options into their DHCPOption types
+func BuildDHCPOptions(conf *OptionsConfig) (DHCPOptions, error) {
+	options := make(DHCPOptions)
+
+	if len(conf.Routers) > 0 {
+		opt, err := ipOption(conf.Routers)
+		if err != nil {
+			return nil, fmt.Errorf("routers: %v", err)
+		}
+		options[RouterOptionCode] = opt
+	}
+
+	if len(conf.DNSServers) > 0 {
+		opt, err := ipOption(conf.DNSServers)
+		if err != nil {
+			return nil, fmt.Errorf("dns_servers: %v", err)
+		}
+		options[DomainNameServerOptionCode] = opt
+	}
+
+	if conf.DomainName != "" {
+		options[DomainNameOptionCode] = &StringDHCPOption{
+			Value: conf.DomainName,
+		}
+	}
+
+	if len(conf.NTPServers) > 0 {
+		opt, err := ipOption(conf.NTPServers)
+		if err != nil {
+			return nil, fmt.Errorf("ntp_servers: %v", err)
+		}
+		options[NTPServerOptionCode] = opt
+	}
+
+	if conf.MTU != 0 {
+		if conf.MTU < 68 || conf.MTU > 65535 {
+			return nil, fmt.Errorf("mtu: %d out of range", conf.MTU)
+		}
+
+		options[InterfaceMTUOptionCode] = &Uint16DHCPOption{
+			Value: []uint16{uint16(conf.MTU)},
+		}
+	}
+
+	if len(conf.StaticRoutes) > 0 {
+		addresses := make([]string, 0, len(conf.StaticRoutes)*2)
+
+		for _, route := range conf.StaticRoutes {
+			addresses = append(addresses, route.Destination, route.Router)
+		}
+
+		opt, err := ipOption(addresses)
+		if err != nil {
+			return nil, fmt.Errorf("static_routes: %v", err)
+		}
+		options[StaticRouteOptionCode] = opt
+	}
+
+	for i, custom := range conf.Custom {
+		if custom.Code <= int(PadOptionCode) || custom.Code >= int(EndOptionCode) {
+			return nil, fmt.Errorf("custom[%d]: invalid option code %d", i, custom.Code)
+		}
+
+		if serverManagedOption(DHCPOptionCode(custom.Code)) {
+			return nil, fmt.Errorf("custom[%d]: option %d is managed by server and can't be configured", i, custom.Code)
+		}
+
+		opt, err := customOption(&custom)
+		if err != nil {
+			return nil, fmt.Errorf("custom[%d]: option %d: %v", i, custom.Code, err)
+		}
+
+		options[DHCPOptionCode(custom.Code)] = opt
+	}
+
+	// encoding of longer ones fails when sending reply
+	for code, opt := range options {
+		if length := len(opt.Encode()); length > maxOptionLength {
+			return nil, fmt.Errorf("option %d: value of %d bytes longer than %d", code, length, maxOptionLength)
+		}
+	}
+
+	return options, nil
+}
+
+// serverManagedOption reports options set by server or client only, configured
+// values would override message type, server identifier or lease times
+func serverManagedOption(code DHCPOptionCode) bool {
+	switch code {
+	case RequestIPAddressOptionCode, IPAddressLeaseTimeOptionCode, OptionOverloadOptionCode,
+		DHCPMessageTypeOptionCode, ServerIdentifierOptionCode, ParameterRequestListOptionCode,
+		MessageOptionCode, MaximumDHCPMessageSizeOptionCode, RenewalTimeValueOptionCode,
+		RebindingTimeValueOptionCode, ClientIdentifierOptionCode, RelayAgentInformationOptionCode:
+		return true
+	}
+
+	return false
+}
+
+// Merge returns copy of options with other's values taking precedence
+func (options DHCPOptions) Merge(other DHCPOptions) DHCPOptions {
+	merged := make(DHCPOptions, len(options)+len(other))
+
+	for code, opt := range options {
+		merged[code] = opt
+	}
+
+	for code, opt := range other {
+		merged[code] = opt
+	}
+
+	return merged
+}
+
+func ipOption(values []string) (*IPDHCPOption, error) {
+	opt := &IPDHCPOption{
+		Value: make([]net.IP, len(values)),
+	}
+
+	for i, str := range values {
+		if opt.Value[i] = net.ParseIP(str).To4(); opt.Value[i] == nil {
+			return nil, fmt.Errorf("Invalid IPv4 address %q", str)
+		}
+	}
+
+	return opt, nil
+}
+
+func customOption(conf *CustomOptionConfig) (DHCPOption, error) {
+	switch conf.Type {
+	case "ip":
+		values, err := stringValues(conf.Value)
+		if err != nil {
+			return nil, err
+		}
+		return ipOption(values)
+
+	case "string":
+		str, ok := conf.Value.(string)
+		if !ok {
+			return nil, errors.New("String value expected")
+		}
+		return &StringDHCPOption{Value: str}, nil
+
+	case "hex":
+		str, ok := conf.Value.(string)
+		if !ok {
+			return nil, errors.New("Hex string value expected")
+		}
+		data, err := parseHexBytes(str)
+		if err != nil {
+			return nil, err
+		}
+		return &Uint8DHCPOption{Value: data}, nil
+
+	case "uint8":
+		values, err := intValues(conf.Value, 0xFF)
+		if err != nil {
+			return nil, err
+		}
+		opt := &Uint8DHCPOption{Value: make([]uint8, len(values))}
+		for i, v := range values {
+			opt.Value[i] = uint8(v)
+		}
+		return opt, nil
+
+	case "uint16":
+		values, err := intValues(conf.Value, 0xFFFF)
+		if err != nil {
+			return nil, err
+		}
+		opt := &Uint16DHCPOption{Value: make([]uint16, len(values))}
+		for i, v := range values {
+			opt.Value[i] = uint16(v)
+		}
+		return opt, nil
+
+	case "duration":
+		switch v := conf.Value.(type) {
+		case string:
+			dur, err := time.ParseDuration(v)
+			if err != nil {
+				return nil, err
+			}
+			return &DurationDHCPOption{Value: dur}, nil
+		case int64:
+			return &DurationDHCPOption{Value: time.Duration(v) * time.Second}, nil
+		}
+		return nil, errors.New("Duration string or seconds expected")
+	}
+
+	return nil, fmt.Errorf("Unknown option type %q", conf.Type)
+}
+
+func stringValues(value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		result := make([]string, len(v))
+		for i, item := range v {
+			str, ok := item.(string)
+			if !ok {
+				return nil, errors.New("String values expected")
+			}
+			result[i] = str
+		}
+		return result, nil
+	}
+
+	return nil, errors.New("String or array of strings expected")
+}
+
+func intValues(value interface{}, limit int64) ([]int64, error) {
+	var result []int64
+
+	switch v := value.(type) {
+	case int64:
+		result = []int64{v}
+	case []interface{}:
+		result = make([]int64, len(v))
+		for i, item := range v {
+			num, ok := item.(int64)
+			if !ok {
+				return nil, errors.New("Integer values expected")
+			}
+			result[i] = num
+		}
+	default:
+		return nil, errors.New("Integer or array of integers expected")
+	}
+
+	for _, num := range result {
+		if num < 0 || num > limit {
+			return nil, fmt.Errorf("Value %d out of range", num)
+		}
+	}
+
+	return result, nil
+}
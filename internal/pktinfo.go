@@ -74,3 +74,53 @@ func WriteUDPWithInterface(conn *net.UDPConn, b []byte, addr *net.UDPAddr, iface
 		Ifindex: iface,
 	})
 }
+
+func EnablePktInfo6(udp *net.UDPConn) error {
+	file, err := udp.File()
+	if err != nil {
+		return err
+	}
+
+	err = syscall.SetsockoptInt(int(file.Fd()), syscall.IPPROTO_IPV6, syscall.IPV6_RECVPKTINFO, 1)
+	return err
+}
+
+// JoinMulticast6 subscribes socket to multicast group on given interface
+func JoinMulticast6(udp *net.UDPConn, group net.IP, iface *net.Interface) error {
+	file, err := udp.File()
+	if err != nil {
+		return err
+	}
+
+	mreq := &syscall.IPv6Mreq{
+		Interface: uint32(iface.Index),
+	}
+	copy(mreq.Multiaddr[:], group.To16())
+
+	return syscall.SetsockoptIPv6Mreq(int(file.Fd()), syscall.IPPROTO_IPV6, syscall.IPV6_JOIN_GROUP, mreq)
+}
+
+func ReadUDP6WithPktInfo(conn *net.UDPConn, b []byte) (int, *net.UDPAddr, syscall.Inet6Pktinfo, error) {
+	var pktInfo syscall.Inet6Pktinfo
+
+	oob := make([]byte, 1024)
+
+	n, oobn, _, addr, err := conn.ReadMsgUDP(b, oob)
+	if err != nil {
+		return n, addr, pktInfo, err
+	}
+
+	messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return n, addr, pktInfo, err
+	}
+
+	for _, msg := range messages {
+		if msg.Header.Level == syscall.IPPROTO_IPV6 && msg.Header.Type == syscall.IPV6_PKTINFO {
+			err = binary.Read(bytes.NewReader(msg.Data), binary.LittleEndian, &pktInfo)
+			return n, addr, pktInfo, err
+		}
+	}
+
+	return n, addr, pktInfo, errors.New("No PKTInfo found ?")
+}
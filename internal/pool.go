@@ -4,22 +4,46 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"log/slog"
 	"math/rand"
 	"net"
+	"sort"
 	"time"
 )
 
 type LeaseState int
 type AddressSelectAlgorithm int
+type ClientIDPolicy int
 
 const (
 	LeaseReserved LeaseState = iota
 	LeaseInUse    LeaseState = iota
+	// address reported in use by someone else, not handed out until expired
+	LeaseDeclined LeaseState = iota
+	// reservation created by administrator, never expires
+	LeaseStatic LeaseState = iota
+	// binding ended but remembered so returning client gets the same address,
+	// recycled least recently used first once pool has no never used addresses
+	LeaseExpired LeaseState = iota
 )
 
+// offers unanswered for this long are reclaimed, unless configured otherwise
+const defaultOfferHold = time.Minute
+
 const (
 	Sequential AddressSelectAlgorithm = iota
 	Randomized AddressSelectAlgorithm = iota
+	// first free address at or after one derived from client identity, so
+	// client tends to get the same address from any server and after lease
+	// database is lost
+	Hashed AddressSelectAlgorithm = iota
+)
+
+const (
+	// client identifier option when present, hardware address otherwise
+	ClientIDPreferred ClientIDPolicy = iota
+	ClientIDMacOnly   ClientIDPolicy = iota
+	ClientIDAndMac    ClientIDPolicy = iota
 )
 
 type ClientIdentifier struct {
@@ -31,47 +55,347 @@ type Lease struct {
 	Address net.IP
 	State   LeaseState
 	ID      ClientIdentifier
+	// IAID of DHCPv6 identity association, ID holds DUID then
+	IAID    uint32
 	Expires time.Time
 }
 
 type LeaseMap map[uint32]*Lease
 
+func (state LeaseState) String() string {
+	switch state {
+	case LeaseReserved:
+		return "reserved"
+	case LeaseInUse:
+		return "in-use"
+	case LeaseDeclined:
+		return "declined"
+	case LeaseStatic:
+		return "static"
+	case LeaseExpired:
+		return "expired"
+	}
+
+	return "unknown"
+}
+
 type Pool struct {
-	Leases    LeaseMap
-	Network   net.IPNet
-	Start     uint32
-	End       uint32
-	Lifetime  time.Duration
-	Algorithm AddressSelectAlgorithm
-	Receiver  chan DirectedDHCPMessage
+	Name     string
+	Leases   LeaseMap
+	Store    LeaseStore
+	Network  net.IPNet
+	Start    uint32
+	End      uint32
+	Lifetime time.Duration
+	// zero means unbounded
+	MinLifetime time.Duration
+	MaxLifetime time.Duration
+	// T1 and T2 as fraction of lease time
+	Renewal    float64
+	Rebinding  float64
+	Classes    []*LeaseClass
+	Quarantine time.Duration
+	// how long offered address stays reserved waiting for client's request
+	OfferHold time.Duration
+	Probe     ProbeMethod
+	// how long to wait for answer to probe before offering address
+	ProbeTimeout time.Duration
+	Algorithm    AddressSelectAlgorithm
+	Identity     ClientIDPolicy
+	Hosts        map[uint32]*StaticHost
+	Agents       AgentIDMatcher
+	Options      DHCPOptions
+	Receiver     chan DirectedDHCPMessage
+	Commands     chan func()
+	Logger       *slog.Logger
+	// partner server the dynamic range is shared with, optional
+	Peer *FailoverPeer
+	// leases reserved for offers still waiting for probe result
+	probing map[*Lease]struct{}
+	// remembered bindings offered back to their clients, see setLease
+	returning map[*Lease]struct{}
+	// free addresses and leases by client, see setLease
+	alloc *allocator
+	// closed once Run returns
+	stopped chan struct{}
 }
 
-func NewPool(conf *PoolConfig) Pool {
-	algo := Randomized
+func NewPool(name string, conf *PoolConfig, store LeaseStore) (*Pool, error) {
+	pool := &Pool{
+		Name:      name,
+		Leases:    make(LeaseMap),
+		Store:     store,
+		Receiver:  make(chan DirectedDHCPMessage, 10),
+		Commands:  make(chan func()),
+		Logger:    Log.With("pool", name),
+		probing:   make(map[*Lease]struct{}),
+		returning: make(map[*Lease]struct{}),
+		stopped:   make(chan struct{}),
+	}
+
+	if err := pool.configure(conf); err != nil {
+		return nil, err
+	}
+
+	pool.rebuildAllocator()
+	pool.restoreLeases()
+
+	return pool, nil
+}
+
+// ValidatePoolConfig checks configuration without creating pool
+func ValidatePoolConfig(name string, conf *PoolConfig) error {
+	pool := &Pool{Name: name, Logger: Log.With("pool", name)}
+
+	return pool.configure(conf)
+}
+
+// configure sets pool parameters, pool is left untouched on error
+func (pool *Pool) configure(conf *PoolConfig) error {
+	_, network, err := net.ParseCIDR(conf.Network)
+	if err != nil {
+		return err
+	}
+
+	if network.IP.To4() == nil {
+		return errors.New("Pool network must be IPv4")
+	}
+
+	lifetime, err := time.ParseDuration(conf.Lifetime)
+	if err != nil {
+		return fmt.Errorf("lifetime: %v", err)
+	}
+
+	minLifetime, err := parseOptionalDuration("min_lifetime", conf.MinLifetime)
+	if err != nil {
+		return err
+	}
+
+	maxLifetime, err := parseOptionalDuration("max_lifetime", conf.MaxLifetime)
+	if err != nil {
+		return err
+	}
+
+	renewal, rebinding, err := renewalTimes(conf.Renewal, conf.Rebinding)
+	if err != nil {
+		return err
+	}
+
+	classes, err := newLeaseClasses(conf.Classes)
+	if err != nil {
+		return err
+	}
+
+	quarantine := time.Hour
+	if conf.Quarantine != "" {
+		if quarantine, err = time.ParseDuration(conf.Quarantine); err != nil {
+			return fmt.Errorf("quarantine: %v", err)
+		}
+	}
 
-	switch conf.Algorithm {
+	offerHold := defaultOfferHold
+	if conf.OfferHold != "" {
+		if offerHold, err = time.ParseDuration(conf.OfferHold); err != nil {
+			return fmt.Errorf("offer_hold: %v", err)
+		}
+	}
+
+	probeTimeout := 500 * time.Millisecond
+	if conf.ProbeTimeout != "" {
+		if probeTimeout, err = time.ParseDuration(conf.ProbeTimeout); err != nil {
+			return fmt.Errorf("probe_timeout: %v", err)
+		}
+	}
+
+	options, err := BuildDHCPOptions(&conf.Options)
+	if err != nil {
+		return fmt.Errorf("options: %v", err)
+	}
+
+	identity := ClientIDPreferred
+
+	switch conf.Identity {
+	case "mac":
+		identity = ClientIDMacOnly
+
+	case "both":
+		identity = ClientIDAndMac
+	}
+
+	pool.Network = net.IPNet{IP: network.IP.To4(), Mask: network.Mask}
+	pool.Start = uint32(conf.Start)
+	pool.End = uint32(conf.End)
+	pool.Lifetime = lifetime
+	pool.MinLifetime = minLifetime
+	pool.MaxLifetime = maxLifetime
+	pool.Renewal = renewal
+	pool.Rebinding = rebinding
+	pool.Classes = classes
+	pool.Quarantine = quarantine
+	pool.OfferHold = offerHold
+	pool.Probe = parseProbeMethod(conf.Probe)
+	pool.ProbeTimeout = probeTimeout
+	pool.Algorithm = parseAlgorithm(conf.Algorithm)
+	pool.Identity = identity
+	pool.Agents = AgentIDMatcher{
+		CircuitIDs: conf.CircuitIDs,
+		RemoteIDs:  conf.RemoteIDs,
+	}
+	pool.Options = options
+	pool.Hosts = make(map[uint32]*StaticHost)
+
+	for hostName, hostConf := range conf.Hosts {
+		host, err := newStaticHost(hostName, &hostConf)
+		if err != nil {
+			pool.Logger.Warn("Ignoring invalid host", "host", hostName, "error", err)
+			continue
+		}
+
+		idx, err := pool.indexFromAddress(host.Address)
+		if err != nil {
+			pool.Logger.Warn("Ignoring invalid host", "host", hostName, "error", err)
+			continue
+		}
+
+		pool.Hosts[idx] = host
+	}
+
+	return nil
+}
+
+// Reconfigure applies new configuration keeping leases still valid under it.
+// Must be called from pool's Run goroutine, see Do.
+func (pool *Pool) Reconfigure(conf *PoolConfig) error {
+	if err := pool.configure(conf); err != nil {
+		return err
+	}
+
+	// indices depend on network, leases have to be indexed again
+	leases := pool.Leases
+	pool.Leases = make(LeaseMap, len(leases))
+
+	for _, lease := range leases {
+		idx, valid := pool.leaseIndex(lease)
+
+		if !valid {
+			pool.Logger.Info("Dropping lease not valid under new configuration", "address", lease.Address)
+			pool.Store.Remove(lease.Address)
+			continue
+		}
+
+		if host := pool.displacedBy(idx, lease); host != nil {
+			pool.Logger.Info("Dropping lease of address now reserved for host", "address", lease.Address, "host", host.Name, "mac", lease.ID.Mac)
+			pool.Store.Remove(lease.Address)
+			continue
+		}
+
+		pool.Leases[idx] = lease
+	}
+
+	pool.rebuildAllocator()
+
+	pool.Logger.Info("Pool reconfigured", "leases", len(pool.Leases))
+
+	return nil
+}
+
+func parseAlgorithm(name string) AddressSelectAlgorithm {
+	switch name {
 	case "sequential":
-		algo = Sequential
+		return Sequential
+	case "hashed":
+		return Hashed
+	}
+
+	return Randomized
+}
 
-	case "random":
-		algo = Randomized
+// leaseIndex returns index of lease, false when address doesn't belong to pool
+func (pool *Pool) leaseIndex(lease *Lease) (uint32, bool) {
+	idx, err := pool.indexFromAddress(lease.Address)
+	if err != nil {
+		return 0, false
 	}
 
-	start := conf.Start
-	end := conf.End
+	_, static := pool.Hosts[idx]
+	static = static || lease.State == LeaseStatic
 
-	_, n, _ := net.ParseCIDR(conf.Network)
-	dur, _ := time.ParseDuration(conf.Lifetime)
+	return idx, static || (idx >= pool.Start && idx <= pool.End)
+}
 
-	return Pool{
-		Leases:    make(LeaseMap),
-		Network:   *n,
-		Start:     uint32(start),
-		End:       uint32(end),
-		Algorithm: algo,
-		Receiver:  make(chan DirectedDHCPMessage, 10),
-		Lifetime:  dur,
+// displacedBy returns host reservation of index lease of other client is in way
+// of, quarantine of declined address still applies
+func (pool *Pool) displacedBy(idx uint32, lease *Lease) *StaticHost {
+	if host, static := pool.Hosts[idx]; static && lease.State != LeaseDeclined && !host.owns(&lease.ID) {
+		return host
 	}
+
+	return nil
+}
+
+func (pool *Pool) restoreLeases() {
+	for _, lease := range pool.Store.Leases() {
+		idx, valid := pool.leaseIndex(lease)
+
+		if !valid {
+			pool.Logger.Warn("Dropping stored lease outside of pool range", "address", lease.Address)
+			pool.Store.Remove(lease.Address)
+			continue
+		}
+
+		if host := pool.displacedBy(idx, lease); host != nil {
+			pool.Logger.Warn("Dropping stored lease of address reserved for host", "address", lease.Address, "host", host.Name, "mac", lease.ID.Mac)
+			pool.Store.Remove(lease.Address)
+			continue
+		}
+
+		pool.setLease(idx, lease)
+	}
+
+	pool.Logger.Info("Restored leases", "count", len(pool.Leases))
+}
+
+// putLease stores lease, also after lease was changed in place
+func (pool *Pool) putLease(idx uint32, lease *Lease) {
+	pool.setLease(idx, lease)
+
+	if err := pool.Store.Put(lease); err != nil {
+		pool.Logger.Error("Unable to store lease", "address", lease.Address, "error", err)
+	}
+}
+
+func (pool *Pool) dropLease(idx uint32) {
+	lease := pool.Leases[idx]
+	pool.setLease(idx, nil)
+
+	if err := pool.Store.Remove(lease.Address); err != nil {
+		pool.Logger.Error("Unable to remove stored lease", "address", lease.Address, "error", err)
+	}
+}
+
+// Do runs fn inside pool's Run goroutine and waits for it to finish,
+// returns false when pool has been stopped and fn didn't run
+func (pool *Pool) Do(fn func()) bool {
+	done := make(chan struct{})
+
+	select {
+	case pool.Commands <- func() {
+		fn()
+		close(done)
+	}:
+	case <-pool.stopped:
+		return false
+	}
+
+	<-done
+
+	return true
+}
+
+// Stop ends Run and waits until lease store is closed
+func (pool *Pool) Stop() {
+	close(pool.Receiver)
+	<-pool.stopped
 }
 
 func (pool *Pool) Run(sender chan<- DirectedDHCPMessage) {
@@ -82,45 +406,50 @@ RunLoop:
 		select {
 		case <-ticker.C:
 			pool.expireOld()
+
+			if err := pool.Store.Compact(pool.Leases); err != nil {
+				pool.Logger.Error("Unable to compact lease store", "error", err)
+			}
+		case cmd := <-pool.Commands:
+			cmd()
 		case msg, more := <-pool.Receiver:
 			if !more {
 				break RunLoop
 			}
 
-			fmt.Println("<<<<<")
-
 			t := msg.Message.Type()
+			log := messageLog(pool.Logger, &msg)
 
 			// some basic validation
 
 			if err := basicValidation(&msg, t); err != nil {
-				fmt.Println("Error while validating DHCP message:", err)
+				log.Warn("Invalid DHCP message", "error", err)
+				validationFailures.Inc(pool.Name)
 				break
 			}
 
+			log.Debug("Handling DHCP message")
+
 			switch t {
 			case DHCPDiscover:
-				fmt.Println("Handling DHCPDiscover")
 				pool.handleDiscover(&msg, sender)
 			case DHCPRequest:
-				fmt.Println("Handling DHCPRequest")
 				pool.handleRequest(&msg, sender)
 			case DHCPDecline:
-				fmt.Println("Handling DHCPDecline")
 				pool.handleDecline(&msg, sender)
 			case DHCPRelease:
-				fmt.Println("Handling DHCPRelease")
 				pool.handleRelease(&msg, sender)
 			case DHCPInform:
-				fmt.Println("Handling DHCPInform")
 				pool.handleInform(&msg, sender)
 			default:
-				fmt.Println("Unknown DHCP message type")
+				log.Warn("Unknown DHCP message type")
 			}
 		}
 	}
 
 	ticker.Stop()
+	pool.Store.Close()
+	close(pool.stopped)
 }
 
 func basicValidation(msg *DirectedDHCPMessage, t DHCPType) error {
@@ -140,43 +469,138 @@ func basicValidation(msg *DirectedDHCPMessage, t DHCPType) error {
 }
 
 func (pool *Pool) expireOld() {
+	now := time.Now()
+
 	for i, lease := range pool.Leases {
-		if lease.Expires.Before(time.Now()) {
-			delete(pool.Leases, i)
-			fmt.Println("Expiration, freeing ", lease.Address)
+		if lease.State == LeaseStatic || lease.State == LeaseExpired || !lease.Expires.Before(now) {
+			continue
+		}
+
+		leaseExpirations.Inc(pool.Name)
+
+		switch lease.State {
+		case LeaseInUse:
+			pool.retire(i, lease)
+			pool.Logger.Info("Lease expired", "address", lease.Address)
+		case LeaseReserved:
+			if _, returning := pool.returning[lease]; returning {
+				// keep remembering whom address belonged to
+				pool.retire(i, lease)
+				pool.Logger.Info("Offer not taken, address remembered", "address", lease.Address)
+				break
+			}
+
+			pool.dropLease(i)
+			pool.Logger.Info("Offer not taken, address reclaimed", "address", lease.Address)
+		default:
+			pool.dropLease(i)
+			pool.Logger.Info("Lease expired", "address", lease.Address, "state", lease.State)
 		}
 	}
 }
 
+// retire frees address while remembering whom it belonged to
+func (pool *Pool) retire(idx uint32, lease *Lease) {
+	lease.State = LeaseExpired
+	// expired leases are recycled by this time, oldest first
+	lease.Expires = time.Now()
+	pool.putLease(idx, lease)
+}
+
 func (pool *Pool) handleDiscover(msg *DirectedDHCPMessage, sender chan<- DirectedDHCPMessage) {
+	log := messageLog(pool.Logger, msg)
 	clientID := newClientIdentifier(&msg.Message)
-	serverIP := pool.serverIP(msg.Interface)
 
-	// find lease for client or reserve new one
+	// static reservation takes precedence over dynamic allocation
+	hostIdx, host := pool.findHost(&msg.Message)
+
 	lease, found := pool.findClientLease(&clientID)
-	if !found {
-		fmt.Println("Lease not found, trying to reserve new one ...")
-		free := pool.freeIndices()
 
-		if len(free) == 0 {
-			fmt.Println("No addresses free, aborting!")
-			// no addresses free, ignore!
+	if _, probing := pool.probing[lease]; found && probing {
+		log.Debug("Address probe in progress, ignoring retransmission", "address", lease.Address)
+		return
+	}
+
+	if host != nil && (!found || !lease.Address.Equal(host.Address)) {
+		if quarantined, exists := pool.Leases[hostIdx]; exists && quarantined.State == LeaseDeclined {
+			log.Warn("Static address is quarantined, not offering", "host", host.Name, "address", host.Address)
 			return
 		}
 
-		idx := selectNumber(pool.Algorithm, free)
+		if found {
+			pool.freeLeases(&clientID)
+		}
 
-		pool.Leases[idx] = &Lease{
-			Address: pool.addressFromIndex(idx),
+		pool.putLease(hostIdx, &Lease{
+			Address: host.Address,
 			ID:      clientID,
 			State:   LeaseReserved,
+			Expires: time.Now().Add(pool.OfferHold),
+		})
+
+		lease = pool.Leases[hostIdx]
+
+		log.Info("Static lease reserved", "host", host.Name, "address", host.Address)
+	} else if !found {
+		if lease = pool.allocate(&clientID, log); lease == nil {
+			return
 		}
 
-		lease = pool.Leases[idx]
+		if pool.Probe != ProbeNone {
+			pool.startProbe(msg, lease, 1, sender)
+			return
+		}
+	} else if lease.State == LeaseExpired {
+		// hold it like fresh offer, so that it isn't recycled meanwhile
+		if idx, valid := pool.leaseIndex(lease); valid {
+			lease.State = LeaseReserved
+			lease.Expires = time.Now().Add(pool.OfferHold)
+			pool.putLease(idx, lease)
+			pool.returning[lease] = struct{}{}
+		}
 
-		fmt.Println("Lease reserved", msg.Message.ClientHwAddr, pool.Leases[idx].Address)
+		log.Info("Offering previous address to returning client", "address", lease.Address)
+	} else if lease.State == LeaseReserved {
+		// client is still selecting, keep holding the address
+		if idx, valid := pool.leaseIndex(lease); valid {
+			lease.Expires = time.Now().Add(pool.OfferHold)
+			pool.putLease(idx, lease)
+		}
 	}
 
+	pool.sendOffer(msg, lease, host, sender)
+}
+
+// allocate reserves free address of dynamic range for client, nil when pool is exhausted
+func (pool *Pool) allocate(clientID *ClientIdentifier, log *slog.Logger) *Lease {
+	idx, found := pool.pickFree(clientID)
+
+	if !found {
+		if idx, found = pool.oldestExpired(); !found {
+			// no addresses free, ignore!
+			log.Warn("No addresses free")
+			return nil
+		}
+
+		log.Info("Recycling address of expired lease", "address", pool.Leases[idx].Address, "mac", pool.Leases[idx].ID.Mac.String())
+	}
+
+	pool.putLease(idx, &Lease{
+		Address: pool.addressFromIndex(idx),
+		ID:      *clientID,
+		State:   LeaseReserved,
+		Expires: time.Now().Add(pool.OfferHold),
+	})
+
+	log.Info("Lease reserved", "address", pool.Leases[idx].Address)
+
+	return pool.Leases[idx]
+}
+
+func (pool *Pool) sendOffer(msg *DirectedDHCPMessage, lease *Lease, host *StaticHost, sender chan<- DirectedDHCPMessage) {
+	log := messageLog(pool.Logger, msg)
+	serverIP := pool.serverIP(msg.Interface)
+
 	// build reply
 	offer := BuildBasicReply(&msg.Message, serverIP)
 	offer.YourIP = lease.Address
@@ -186,85 +610,211 @@ func (pool *Pool) handleDiscover(msg *DirectedDHCPMessage, sender chan<- Directe
 			uint8(DHCPOffer),
 		},
 	}
-	offer.Options[SubnetMaskOptionCode] = &IPDHCPOption{
-		Value: []net.IP{
-			net.IPv4(pool.Network.Mask[0], pool.Network.Mask[1], pool.Network.Mask[2], pool.Network.Mask[3]),
-		},
+	pool.addLeaseTimeOptions(&offer, pool.leaseTime(&msg.Message, host))
+	pool.configuredOptions(&offer, host)
+	selectReplyOptions(&msg.Message, &offer)
+
+	log.Debug("Sending offer", "address", lease.Address)
+	DumpDHCPMessage(pool.Logger, "Sending", &offer)
+
+	sender <- directReply(msg, offer)
+}
+
+// startProbe checks nobody uses reserved address before it's offered. Probe
+// runs in its own goroutine so other clients aren't held up meanwhile, its
+// result is handled back in Run goroutine.
+func (pool *Pool) startProbe(msg *DirectedDHCPMessage, lease *Lease, attempt int, sender chan<- DirectedDHCPMessage) {
+	method := pool.Probe
+
+	// ARP doesn't cross routers
+	if method == ProbeARP && msg.Message.Relayed() {
+		method = ProbeICMP
 	}
-	offer.Options[RouterOptionCode] = &IPDHCPOption{
-		Value: []net.IP{
-			serverIP,
-		},
+
+	pool.probing[lease] = struct{}{}
+
+	request := *msg
+	timeout := pool.ProbeTimeout
+
+	go func() {
+		conflict, err := probeAddress(method, request.Interface, lease.Address, timeout)
+
+		pool.Do(func() {
+			pool.finishProbe(&request, lease, attempt, conflict, err, sender)
+		})
+	}()
+}
+
+func (pool *Pool) finishProbe(msg *DirectedDHCPMessage, lease *Lease, attempt int, conflict bool, probeErr error, sender chan<- DirectedDHCPMessage) {
+	log := messageLog(pool.Logger, msg)
+
+	delete(pool.probing, lease)
+
+	// expired, released or dropped by reload meanwhile
+	idx, err := pool.indexFromAddress(lease.Address)
+	if err != nil || pool.Leases[idx] != lease {
+		log.Debug("Probed lease is gone, not offering", "address", lease.Address)
+		return
 	}
-	offer.Options[DomainNameServerOptionCode] = &IPDHCPOption{
-		Value: []net.IP{
-			serverIP,
-		},
+
+	if probeErr != nil {
+		// probing is best effort, failure mustn't stop clients from getting address
+		log.Warn("Address probe failed, offering anyway", "address", lease.Address, "error", probeErr)
+	} else if conflict {
+		log.Warn("Address in use by unknown host, quarantining", "address", lease.Address, "quarantine", pool.Quarantine)
+		probeConflicts.Inc(pool.Name)
+
+		pool.putLease(idx, &Lease{
+			Address: lease.Address,
+			State:   LeaseDeclined,
+			Expires: time.Now().Add(pool.Quarantine),
+		})
+
+		if attempt >= maxProbeAttempts {
+			log.Warn("No conflict free address found, not offering", "attempts", attempt)
+			return
+		}
+
+		clientID := newClientIdentifier(&msg.Message)
+
+		if next := pool.allocate(&clientID, log); next != nil {
+			pool.startProbe(msg, next, attempt+1, sender)
+		}
+
+		return
 	}
-	offer.Options[IPAddressLeaseTimeOptionCode] = &DurationDHCPOption{
-		Value: pool.Lifetime,
+
+	pool.sendOffer(msg, lease, nil, sender)
+}
+
+// requestState is client state a DHCPREQUEST is sent from, RFC 2131 4.3.2
+type requestState int
+
+const (
+	// answering our or other server's offer
+	requestSelecting requestState = iota
+	// verifying previously allocated address after reboot
+	requestInitReboot requestState = iota
+	// extending lease, unicast to server that granted it
+	requestRenewing requestState = iota
+	// extending lease, broadcast to any server
+	requestRebinding requestState = iota
+)
+
+func (state requestState) String() string {
+	switch state {
+	case requestSelecting:
+		return "selecting"
+	case requestInitReboot:
+		return "init-reboot"
+	case requestRenewing:
+		return "renewing"
 	}
 
-	fmt.Println("Sending offer")
-	DebugDHCPMessage(&offer)
+	return "rebinding"
+}
 
-	sender <- DirectedDHCPMessage{
-		Message:   offer,
-		Interface: msg.Interface,
-		Remote:    msg.Remote,
+func newRequestState(msg *DirectedDHCPMessage) requestState {
+	switch {
+	case msg.Message.ServerIdentifier() != nil:
+		return requestSelecting
+	case msg.Message.RequestedIP() != nil:
+		return requestInitReboot
+	case msg.Unicast && !msg.Message.Relayed():
+		// relay agents forward only broadcasts
+		return requestRenewing
 	}
+
+	return requestRebinding
 }
 
 func (pool *Pool) handleRequest(msg *DirectedDHCPMessage, sender chan<- DirectedDHCPMessage) {
+	state := newRequestState(msg)
+	log := messageLog(pool.Logger, msg).With("state", state.String())
 	clientID := newClientIdentifier(&msg.Message)
 	serverIP := pool.serverIP(msg.Interface)
-	selectedServer := msg.Message.ServerIdentifier()
-	requestedIP := msg.Message.RequestedIP()
 
-	if requestedIP == nil {
-		if msg.Message.ClientIP.Equal(net.IPv4zero) {
-			fmt.Println("DHCPRequest bez IP")
+	var requestedIP net.IP
+
+	switch state {
+	case requestSelecting:
+		if selectedServer := msg.Message.ServerIdentifier(); !serverIP.Equal(selectedServer) {
+			log.Info("Client selected different server, freeing its leases", "server", selectedServer)
+
+			if pool.Peer != nil {
+				// lease granted by failover partner may be already here
+				pool.freeOffers(&clientID)
+			} else {
+				pool.freeLeases(&clientID)
+			}
 			return
 		}
-		requestedIP = msg.Message.ClientIP
-	}
 
-	if selectedServer != nil && !serverIP.Equal(selectedServer) {
-		fmt.Println("Server IP not equal, clearing client leases")
-		pool.freeLeases(&clientID)
-		return
-	}
+		if requestedIP = msg.Message.RequestedIP(); requestedIP == nil {
+			log.Warn("DHCPRequest without requested IP, ignoring")
+			return
+		}
+
+	case requestInitReboot:
+		requestedIP = msg.Message.RequestedIP()
 
-	if selectedServer == nil {
-		fmt.Println("Client refreshing old lease")
-	} else {
-		fmt.Println("Accepting new IP")
+	default:
+		if requestedIP = msg.Message.ClientIP; isZeroIP(requestedIP) {
+			log.Warn("DHCPRequest without requested or client IP, ignoring")
+			return
+		}
 	}
 
-	// validate requested IP
+	log.Debug("Requested address", "address", requestedIP)
+
+	// pool was picked by interface or relay agent, address outside of its
+	// network means client moved to another subnet
 	idx, err := pool.indexFromAddress(requestedIP)
 	if err != nil {
-		if selectedServer != nil {
-			pool.sendNack(msg, sender, serverIP, "Invalid address")
-		}
+		pool.sendNack(msg, sender, serverIP, "Address not valid on this network")
 		return
 	}
 	lease, found := pool.Leases[idx]
+
+	hostIdx, host := pool.findHost(&msg.Message)
+	if host != nil {
+		if hostIdx != idx {
+			pool.sendNack(msg, sender, serverIP, "Client has a different reserved address")
+			return
+		}
+
+		// static reservations are granted even without preceding discover
+		if !found || !pool.sameClient(&lease.ID, &clientID) {
+			lease = &Lease{
+				Address: host.Address,
+				ID:      clientID,
+			}
+			found = true
+		}
+	}
+
 	if !found {
-		if selectedServer != nil {
+		switch state {
+		case requestSelecting, requestRenewing:
 			pool.sendNack(msg, sender, serverIP, "No lease found")
+		default:
+			// RFC 2131 4.3.2: other server may know the client
+			log.Debug("No record of client, staying silent", "address", requestedIP)
 		}
 		return
 	}
-	if !lease.ID.equals(&clientID) {
-		if selectedServer != nil {
-			pool.sendNack(msg, sender, serverIP, "Requested IP address is leased by different client")
-		}
+	if !pool.sameClient(&lease.ID, &clientID) {
+		pool.sendNack(msg, sender, serverIP, "Requested IP address is leased by different client")
 		return
 	}
 
-	lease.State = LeaseInUse
-	lease.Expires = time.Now().Add(pool.Lifetime)
+	lifetime := pool.leaseTime(&msg.Message, host)
+
+	if lease.State != LeaseStatic {
+		lease.State = LeaseInUse
+		lease.Expires = time.Now().Add(lifetime)
+		pool.putLease(idx, lease)
+	}
 
 	// build ack
 	ack := BuildBasicReply(&msg.Message, serverIP)
@@ -275,33 +825,14 @@ func (pool *Pool) handleRequest(msg *DirectedDHCPMessage, sender chan<- Directed
 			uint8(DHCPAck),
 		},
 	}
-	ack.Options[SubnetMaskOptionCode] = &IPDHCPOption{
-		Value: []net.IP{
-			net.IPv4(pool.Network.Mask[0], pool.Network.Mask[1], pool.Network.Mask[2], pool.Network.Mask[3]),
-		},
-	}
-	ack.Options[RouterOptionCode] = &IPDHCPOption{
-		Value: []net.IP{
-			serverIP,
-		},
-	}
-	ack.Options[DomainNameServerOptionCode] = &IPDHCPOption{
-		Value: []net.IP{
-			serverIP,
-		},
-	}
-	ack.Options[IPAddressLeaseTimeOptionCode] = &DurationDHCPOption{
-		Value: pool.Lifetime,
-	}
+	pool.addLeaseTimeOptions(&ack, lifetime)
+	pool.configuredOptions(&ack, host)
+	selectReplyOptions(&msg.Message, &ack)
 
-	fmt.Println("Sending ACK")
-	DebugDHCPMessage(&ack)
+	log.Info("Lease acknowledged", "address", lease.Address)
+	DumpDHCPMessage(pool.Logger, "Sending", &ack)
 
-	sender <- DirectedDHCPMessage{
-		Message:   ack,
-		Interface: msg.Interface,
-		Remote:    msg.Remote,
-	}
+	sender <- directReply(msg, ack)
 }
 
 func (pool *Pool) sendNack(msg *DirectedDHCPMessage, sender chan<- DirectedDHCPMessage, serverIP net.IP, reason string) {
@@ -316,40 +847,117 @@ func (pool *Pool) sendNack(msg *DirectedDHCPMessage, sender chan<- DirectedDHCPM
 		Value: reason,
 	}
 
-	fmt.Println("Sending NAK")
-	DebugDHCPMessage(&nak)
+	messageLog(pool.Logger, msg).Info("Sending NAK", "reason", reason)
+	DumpDHCPMessage(pool.Logger, "Sending", &nak)
 
-	sender <- DirectedDHCPMessage{
-		Message:   nak,
-		Interface: msg.Interface,
-		Remote:    msg.Remote,
-	}
+	sender <- directReply(msg, nak)
 }
 
 func (pool *Pool) handleDecline(msg *DirectedDHCPMessage, sender chan<- DirectedDHCPMessage) {
-	// TODO:
+	log := messageLog(pool.Logger, msg)
+	clientID := newClientIdentifier(&msg.Message)
+	serverIP := pool.serverIP(msg.Interface)
+	selectedServer := msg.Message.ServerIdentifier()
+	declinedIP := msg.Message.RequestedIP()
+
+	if selectedServer == nil || !serverIP.Equal(selectedServer) {
+		log.Debug("DHCPDecline for different server, ignoring")
+		return
+	}
+
+	if declinedIP == nil {
+		log.Warn("DHCPDecline without requested IP, ignoring")
+		return
+	}
+
+	idx, err := pool.indexFromAddress(declinedIP)
+	if err != nil {
+		log.Warn("DHCPDecline for invalid address, ignoring", "address", declinedIP)
+		return
+	}
+
+	lease, found := pool.Leases[idx]
+	if !found || lease.State == LeaseDeclined || !pool.sameClient(&lease.ID, &clientID) {
+		log.Warn("DHCPDecline for address not leased to client, ignoring", "address", declinedIP)
+		return
+	}
+
+	if lease.State == LeaseStatic {
+		log.Warn("Address conflict reported on reserved address", "address", declinedIP)
+		return
+	}
+
+	log.Warn("Address conflict reported, quarantining", "address", declinedIP, "quarantine", pool.Quarantine)
+
+	pool.freeLeases(&clientID)
+	pool.putLease(idx, &Lease{
+		Address: lease.Address,
+		State:   LeaseDeclined,
+		Expires: time.Now().Add(pool.Quarantine),
+	})
 }
 
 func (pool *Pool) handleRelease(msg *DirectedDHCPMessage, sender chan<- DirectedDHCPMessage) {
 	clientID := newClientIdentifier(&msg.Message)
 	serverIP := pool.serverIP(msg.Interface)
 
-	if msg.Message.ServerIP.Equal(serverIP) {
-		pool.freeLeases(&clientID)
+	if !msg.Message.ServerIP.Equal(serverIP) {
+		return
+	}
+
+	// RFC 2131 4.3.4: address is free, but client's binding is worth remembering
+	for _, i := range pool.clientLeases(&clientID) {
+		lease := pool.Leases[i]
+
+		switch lease.State {
+		case LeaseInUse:
+			pool.retire(i, lease)
+			pool.Logger.Info("Lease released", "address", lease.Address)
+		case LeaseReserved:
+			pool.dropLease(i)
+		}
 	}
 }
 
+// handleInform hands out configuration to clients with externally configured address
 func (pool *Pool) handleInform(msg *DirectedDHCPMessage, sender chan<- DirectedDHCPMessage) {
-	// TODO:
+	log := messageLog(pool.Logger, msg)
+	serverIP := pool.serverIP(msg.Interface)
+	clientIP := msg.Message.ClientIP
+
+	if clientIP == nil || clientIP.Equal(net.IPv4zero) {
+		log.Warn("DHCPInform without client IP, ignoring")
+		return
+	}
+
+	_, host := pool.findHost(&msg.Message)
+
+	// RFC 2131 4.3.5: no lease time and yiaddr, unicast to ciaddr
+	ack := BuildBasicReply(&msg.Message, serverIP)
+	ack.ClientIP = clientIP
+
+	ack.Options[DHCPMessageTypeOptionCode] = &Uint8DHCPOption{
+		Value: []uint8{
+			uint8(DHCPAck),
+		},
+	}
+	pool.configuredOptions(&ack, host)
+	selectReplyOptions(&msg.Message, &ack)
+
+	log.Debug("Sending ACK for inform", "address", clientIP)
+	DumpDHCPMessage(pool.Logger, "Sending", &ack)
+
+	sender <- directReply(msg, ack)
 }
 
+// indices are host part of address within pool network
 func (pool *Pool) addressFromIndex(index uint32) net.IP {
 	mask := (uint32(pool.Network.IP[0]) << 24) |
 		(uint32(pool.Network.IP[1]) << 16) |
 		(uint32(pool.Network.IP[2]) << 8) |
 		uint32(pool.Network.IP[3])
 
-	mask |= index + pool.Start
+	mask |= index
 
 	return net.IPv4(byte(mask>>24&0xFF), byte(mask>>16&0xFF), byte(mask>>8&0xFF), byte(mask&0xFF))
 }
@@ -366,66 +974,173 @@ func (pool *Pool) indexFromAddress(ip net.IP) (uint32, error) {
 		return 0, errors.New("Invalid IPv4 address")
 	}
 
+	if !pool.Network.Contains(ip4) {
+		return 0, errors.New("Address outside of pool network")
+	}
+
 	ipaddr := (uint32(ip4[0]) << 24) |
 		(uint32(ip4[1]) << 16) |
 		(uint32(ip4[2]) << 8) |
 		uint32(ip4[3])
 
-	// TODO: validation
-	//network := ipaddr & mask
-	idx := (ipaddr & ^mask) - pool.Start
-
-	fmt.Println("Index from address:", idx)
+	idx := ipaddr & ^mask
 
 	return idx, nil
 }
 
-func selectNumber(algo AddressSelectAlgorithm, indices []uint32) uint32 {
+// selectNumber picks one of ascending indices, preferred is used by Hashed only
+func selectNumber(algo AddressSelectAlgorithm, indices []uint32, preferred uint32) uint32 {
 	switch algo {
 	case Sequential:
 		return indices[0]
 
 	case Randomized:
 		return indices[rand.Intn(len(indices))]
+
+	case Hashed:
+		i := sort.Search(len(indices), func(i int) bool {
+			return indices[i] >= preferred
+		})
+
+		// wrap around when there's nothing free after preferred one
+		return indices[i%len(indices)]
 	}
 
 	return 0
 }
 
-func (pool *Pool) freeIndices() []uint32 {
-	result := make([]uint32, 0)
+// findClientLease returns binding of client, remembered expired one only when there's no other
+func (pool *Pool) findClientLease(id *ClientIdentifier) (*Lease, bool) {
+	var expired *Lease
 
-	for i := pool.Start; i <= pool.End; i++ {
-		if _, exists := pool.Leases[i]; !exists {
-			result = append(result, i)
+	for _, idx := range pool.clientIndices(id) {
+		l := pool.Leases[idx]
+
+		if l.State != LeaseExpired {
+			return l, true
 		}
+
+		expired = l
 	}
 
-	return result
+	return expired, expired != nil
 }
 
-func (pool *Pool) findClientLease(id *ClientIdentifier) (*Lease, bool) {
-	for _, l := range pool.Leases {
-		if l.ID.equals(id) {
-			return l, true
+// oldestExpired returns least recently used remembered address this server may allocate
+func (pool *Pool) oldestExpired() (uint32, bool) {
+	lo, hi := pool.ownRange()
+
+	for e := pool.alloc.expired.Front(); e != nil; e = e.Next() {
+		idx := e.Value.(uint32)
+
+		if _, static := pool.Hosts[idx]; !static && idx >= lo && idx <= hi {
+			return idx, true
 		}
 	}
 
-	return nil, false
+	return 0, false
 }
 
+// freeLeases drops dynamic leases of client, reservations are kept
 func (pool *Pool) freeLeases(id *ClientIdentifier) {
-	for i, lease := range pool.Leases {
-		if pool.Leases[i].ID.equals(id) {
-			// removing items from map inside range is legal
-			delete(pool.Leases, i)
-			fmt.Println("Freeing ", lease.Address)
+	for _, i := range pool.clientLeases(id) {
+		if lease := pool.Leases[i]; lease.State != LeaseStatic {
+			pool.dropLease(i)
+			pool.Logger.Info("Lease freed", "address", lease.Address)
+		}
+	}
+}
+
+// freeOffers drops addresses reserved for client but not yet acknowledged
+func (pool *Pool) freeOffers(id *ClientIdentifier) {
+	for _, i := range pool.clientLeases(id) {
+		if lease := pool.Leases[i]; lease.State == LeaseReserved {
+			pool.dropLease(i)
+			pool.Logger.Info("Offer withdrawn", "address", lease.Address)
+		}
+	}
+}
+
+// reservableIndex returns index of address administrator may reserve, network,
+// broadcast and server's own addresses can't be handed out
+func (pool *Pool) reservableIndex(ip net.IP) (uint32, error) {
+	idx, err := pool.indexFromAddress(ip)
+	if err != nil {
+		return 0, err
+	}
+
+	if ones, bits := pool.Network.Mask.Size(); ones <= 30 {
+		if idx == 0 {
+			return 0, errors.New("Address is network address")
+		}
+
+		if idx == 1<<uint(bits-ones)-1 {
+			return 0, errors.New("Address is broadcast address")
 		}
 	}
+
+	if localAddress(ip) {
+		return 0, errors.New("Address belongs to server")
+	}
+
+	return idx, nil
+}
+
+// reserve binds address to client permanently, replacing client's other leases
+func (pool *Pool) reserve(lease *Lease) error {
+	idx, err := pool.reservableIndex(lease.Address)
+	if err != nil {
+		return err
+	}
+
+	if host, static := pool.Hosts[idx]; static {
+		return fmt.Errorf("Address is reserved for host %s", host.Name)
+	}
+
+	if existing, found := pool.Leases[idx]; found && existing.State != LeaseExpired &&
+		(existing.State == LeaseDeclined || !pool.sameClient(&existing.ID, &lease.ID)) {
+		return errors.New("Address is leased by different client")
+	}
+
+	for _, i := range pool.clientLeases(&lease.ID) {
+		pool.dropLease(i)
+	}
+
+	pool.Logger.Info("Reservation created", "address", lease.Address, "mac", lease.ID.Mac)
+	pool.putLease(idx, lease)
+
+	return nil
 }
 
-func (id *ClientIdentifier) equals(other *ClientIdentifier) bool {
-	if len(id.ID) > 0 {
+// release drops lease of address regardless of its state
+func (pool *Pool) release(ip net.IP) bool {
+	idx, err := pool.indexFromAddress(ip)
+	if err != nil {
+		return false
+	}
+
+	lease, found := pool.Leases[idx]
+	if !found {
+		return false
+	}
+
+	pool.Logger.Info("Lease released by administrator", "address", lease.Address)
+	pool.dropLease(idx)
+
+	return true
+}
+
+func (pool *Pool) sameClient(id *ClientIdentifier, other *ClientIdentifier) bool {
+	switch pool.Identity {
+	case ClientIDMacOnly:
+		return bytes.Equal(id.Mac, other.Mac)
+
+	case ClientIDAndMac:
+		return bytes.Equal(id.ID, other.ID) && bytes.Equal(id.Mac, other.Mac)
+	}
+
+	// RFC 2131 4.2: client-id, if any, is the only identity that matters
+	if len(id.ID) > 0 || len(other.ID) > 0 {
 		return bytes.Equal(id.ID, other.ID)
 	}
 
@@ -434,10 +1149,24 @@ func (id *ClientIdentifier) equals(other *ClientIdentifier) bool {
 
 func newClientIdentifier(msg *DHCPMessage) ClientIdentifier {
 	return ClientIdentifier{
+		ID:  msg.ClientID(),
 		Mac: msg.ClientHwAddr,
 	}
 }
 
+// localAddress reports whether address is assigned to any interface of server
+func localAddress(ip net.IP) bool {
+	addresses, _ := net.InterfaceAddrs()
+
+	for _, addr := range addresses {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (pool *Pool) serverIP(iface *net.Interface) net.IP {
 	addresses, _ := iface.Addrs()
 
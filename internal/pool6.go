@@ -0,0 +1,621 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// largest address range of pool, free addresses are searched linearly
+const maxPool6Size = 1 << 16
+
+// how long advertised address is held for client that hasn't requested it yet
+const advertiseHoldTime = 60 * time.Second
+
+// Pool6 is DHCPv6 IA_NA address pool. Indices are the lowest 32 bits of
+// address, offset from pool network.
+type Pool6 struct {
+	Name        string
+	Leases      LeaseMap
+	Store       LeaseStore
+	Network     net.IPNet
+	Start       uint32
+	End         uint32
+	Lifetime    time.Duration
+	Preferred   time.Duration
+	Quarantine  time.Duration
+	Algorithm   AddressSelectAlgorithm
+	RapidCommit bool
+	Options     DHCPv6Options
+	Delegation  *PrefixPool
+	Receiver    chan DirectedDHCPv6Message
+	Logger      *slog.Logger
+	// closed once Run returns
+	stopped chan struct{}
+}
+
+// NewPool6 creates pool, network may be empty for delegation only pools
+func NewPool6(name string, conf *Pool6Config, store LeaseStore, delegation *PrefixPool) (*Pool6, error) {
+	var network net.IPNet
+	var lifetime, preferred time.Duration
+
+	quarantine := time.Hour
+
+	if conf.Network != "" {
+		_, n, err := net.ParseCIDR(conf.Network)
+		if err != nil {
+			return nil, err
+		}
+
+		if n.IP.To4() != nil {
+			return nil, errors.New("Pool network must be IPv6")
+		}
+
+		// free addresses are searched linearly
+		if conf.Start < 0 || conf.Start > conf.End || conf.End-conf.Start >= maxPool6Size {
+			return nil, fmt.Errorf("Range %d-%d invalid or larger than %d addresses", conf.Start, conf.End, maxPool6Size)
+		}
+
+		network = *n
+
+		if lifetime, err = time.ParseDuration(conf.Lifetime); err != nil {
+			return nil, fmt.Errorf("lifetime: %v", err)
+		}
+
+		preferred = lifetime
+		if conf.Preferred != "" {
+			if preferred, err = time.ParseDuration(conf.Preferred); err != nil {
+				return nil, fmt.Errorf("preferred: %v", err)
+			}
+		}
+
+		if conf.Quarantine != "" {
+			if quarantine, err = time.ParseDuration(conf.Quarantine); err != nil {
+				return nil, fmt.Errorf("quarantine: %v", err)
+			}
+		}
+	}
+
+	pool := &Pool6{
+		Name:        name,
+		Leases:      make(LeaseMap),
+		Store:       store,
+		Network:     network,
+		Start:       uint32(conf.Start),
+		End:         uint32(conf.End),
+		Lifetime:    lifetime,
+		Preferred:   preferred,
+		Quarantine:  quarantine,
+		Algorithm:   parseAlgorithm(conf.Algorithm),
+		RapidCommit: conf.RapidCommit,
+		Options:     make(DHCPv6Options, 0),
+		Delegation:  delegation,
+		Receiver:    make(chan DirectedDHCPv6Message, 10),
+		Logger:      Log.With("pool", name),
+		stopped:     make(chan struct{}),
+	}
+
+	if len(conf.DNSServers) > 0 {
+		servers := make([]net.IP, 0, len(conf.DNSServers))
+
+		for _, str := range conf.DNSServers {
+			if ip := net.ParseIP(str); ip != nil && ip.To4() == nil {
+				servers = append(servers, ip)
+			} else {
+				pool.Logger.Warn("Ignoring invalid IPv6 DNS server", "server", str)
+			}
+		}
+
+		pool.Options.Add(DNSServersv6OptionCode, encodeIPv6List(servers))
+	}
+
+	if len(conf.DomainSearch) > 0 {
+		pool.Options.Add(DomainListv6OptionCode, encodeDomainList(conf.DomainSearch))
+	}
+
+	pool.restoreLeases()
+
+	return pool, nil
+}
+
+func (pool *Pool6) restoreLeases() {
+	for _, lease := range pool.Store.Leases() {
+		idx, err := pool.indexFromAddress(lease.Address)
+
+		if err != nil || idx < pool.Start || idx > pool.End {
+			pool.Logger.Warn("Dropping stored lease outside of pool range", "address", lease.Address)
+			pool.Store.Remove(lease.Address)
+			continue
+		}
+
+		pool.Leases[idx] = lease
+	}
+
+	pool.Logger.Info("Restored leases", "count", len(pool.Leases))
+}
+
+func (pool *Pool6) putLease(idx uint32, lease *Lease) {
+	pool.Leases[idx] = lease
+
+	if err := pool.Store.Put(lease); err != nil {
+		pool.Logger.Error("Unable to store lease", "address", lease.Address, "error", err)
+	}
+}
+
+func (pool *Pool6) dropLease(idx uint32) {
+	lease := pool.Leases[idx]
+	delete(pool.Leases, idx)
+
+	if err := pool.Store.Remove(lease.Address); err != nil {
+		pool.Logger.Error("Unable to remove stored lease", "address", lease.Address, "error", err)
+	}
+}
+
+func (pool *Pool6) Run(sender chan<- DirectedDHCPv6Message) {
+	ticker := time.NewTicker(time.Second * 10)
+
+RunLoop:
+	for {
+		select {
+		case <-ticker.C:
+			pool.expireOld()
+
+			if err := pool.Store.Compact(pool.Leases); err != nil {
+				pool.Logger.Error("Unable to compact lease store", "error", err)
+			}
+
+			if pool.Delegation != nil {
+				pool.Delegation.expireOld()
+			}
+		case msg, more := <-pool.Receiver:
+			if !more {
+				break RunLoop
+			}
+
+			log := messageLog6(pool.Logger, &msg)
+			serverDUID := NewDUIDLL(msg.Interface.HardwareAddr)
+
+			if err := basicValidationv6(&msg.Message, serverDUID); err != nil {
+				log.Warn("Invalid DHCPv6 message", "error", err)
+				break
+			}
+
+			log.Debug("Handling DHCPv6 message")
+
+			switch msg.Message.Type {
+			case DHCPv6Solicit:
+				pool.handleSolicit(&msg, serverDUID, sender)
+			case DHCPv6Request:
+				pool.handleRequest(&msg, serverDUID, sender)
+			case DHCPv6Renew, DHCPv6Rebind:
+				pool.handleRenew(&msg, serverDUID, sender)
+			case DHCPv6Release:
+				pool.handleRelease(&msg, serverDUID, sender)
+			case DHCPv6Decline:
+				pool.handleDecline(&msg, serverDUID, sender)
+			default:
+				log.Warn("Unsupported DHCPv6 message type")
+			}
+		}
+	}
+
+	ticker.Stop()
+	pool.Store.Close()
+
+	if pool.Delegation != nil {
+		pool.Delegation.Store.Close()
+	}
+
+	close(pool.stopped)
+}
+
+// Stop ends Run and waits until lease stores are closed, so sender may be closed afterwards
+func (pool *Pool6) Stop() {
+	close(pool.Receiver)
+	<-pool.stopped
+}
+
+// basicValidationv6 checks identifiers required by RFC 8415 section 16
+func basicValidationv6(msg *DHCPv6Message, serverDUID []byte) error {
+	if len(msg.ClientDUID()) == 0 {
+		return errors.New("Client identifier missing")
+	}
+
+	serverID := msg.ServerDUID()
+
+	switch msg.Type {
+	case DHCPv6Solicit, DHCPv6Rebind:
+		if serverID != nil {
+			return errors.New("Unexpected server identifier")
+		}
+
+	case DHCPv6Request, DHCPv6Renew, DHCPv6Release, DHCPv6Decline:
+		if !bytes.Equal(serverID, serverDUID) {
+			return errors.New("Message addressed to different server")
+		}
+	}
+
+	return nil
+}
+
+func (pool *Pool6) expireOld() {
+	for i, lease := range pool.Leases {
+		if lease.Expires.Before(time.Now()) {
+			pool.dropLease(i)
+			pool.Logger.Info("Lease expired", "address", lease.Address, "state", lease.State)
+		}
+	}
+}
+
+func (pool *Pool6) handleSolicit(msg *DirectedDHCPv6Message, serverDUID []byte, sender chan<- DirectedDHCPv6Message) {
+	rapid := pool.RapidCommit && msg.Message.RapidCommit()
+	replyType := DHCPv6Advertise
+	state := LeaseReserved
+
+	if rapid {
+		replyType = DHCPv6Reply
+		state = LeaseInUse
+	}
+
+	reply := BuildBasicReplyv6(&msg.Message, replyType, serverDUID)
+
+	if rapid {
+		reply.Options.Add(RapidCommitv6OptionCode, []byte{})
+	}
+
+	ias := msg.Message.IANAs()
+
+	if len(ias) == 0 && len(msg.Message.IAPDs()) == 0 {
+		reply.Options.AddStatus(DHCPv6NoAddrsAvail, "No IA requested")
+	}
+
+	for _, ia := range ias {
+		out := IANA{IAID: ia.IAID}
+		lease, ok := pool.bind(msg.Message.ClientDUID(), ia.IAID, state)
+
+		if ok {
+			pool.addLeaseToIA(&out, lease)
+		} else {
+			out.Options.AddStatus(DHCPv6NoAddrsAvail, "No addresses available")
+		}
+
+		reply.Options.Add(IANAv6OptionCode, out.Encode())
+	}
+
+	pool.delegatePrefixes(&msg.Message, &reply, state)
+	pool.send(msg, reply, sender)
+}
+
+func (pool *Pool6) handleRequest(msg *DirectedDHCPv6Message, serverDUID []byte, sender chan<- DirectedDHCPv6Message) {
+	reply := BuildBasicReplyv6(&msg.Message, DHCPv6Reply, serverDUID)
+
+	for _, ia := range msg.Message.IANAs() {
+		out := IANA{IAID: ia.IAID}
+		lease, ok := pool.bind(msg.Message.ClientDUID(), ia.IAID, LeaseInUse)
+
+		if ok {
+			pool.addLeaseToIA(&out, lease)
+		} else {
+			out.Options.AddStatus(DHCPv6NoAddrsAvail, "No addresses available")
+		}
+
+		reply.Options.Add(IANAv6OptionCode, out.Encode())
+	}
+
+	pool.delegatePrefixes(&msg.Message, &reply, LeaseInUse)
+	pool.send(msg, reply, sender)
+}
+
+func (pool *Pool6) handleRenew(msg *DirectedDHCPv6Message, serverDUID []byte, sender chan<- DirectedDHCPv6Message) {
+	reply := BuildBasicReplyv6(&msg.Message, DHCPv6Reply, serverDUID)
+	duid := msg.Message.ClientDUID()
+
+	for _, ia := range msg.Message.IANAs() {
+		out := IANA{IAID: ia.IAID}
+		idx, lease, found := pool.findBinding(duid, ia.IAID)
+
+		if found {
+			lease.State = LeaseInUse
+			lease.Expires = time.Now().Add(pool.Lifetime)
+			pool.putLease(idx, lease)
+			pool.addLeaseToIA(&out, lease)
+		}
+
+		// addresses client shouldn't use anymore get zero lifetimes
+		invalid := false
+
+		for _, addr := range ia.Addresses() {
+			if found && addr.Address.Equal(lease.Address) {
+				continue
+			}
+
+			if found || !pool.Network.Contains(addr.Address) {
+				invalid = true
+				zero := IAAddress{Address: addr.Address}
+				out.Options.Add(IAAddressv6OptionCode, zero.Encode())
+			}
+		}
+
+		if !found && !invalid {
+			out.Options.AddStatus(DHCPv6NoBinding, "No binding for IA")
+		}
+
+		reply.Options.Add(IANAv6OptionCode, out.Encode())
+	}
+
+	pool.renewPrefixes(&msg.Message, &reply)
+	pool.send(msg, reply, sender)
+}
+
+func (pool *Pool6) handleRelease(msg *DirectedDHCPv6Message, serverDUID []byte, sender chan<- DirectedDHCPv6Message) {
+	reply := BuildBasicReplyv6(&msg.Message, DHCPv6Reply, serverDUID)
+	duid := msg.Message.ClientDUID()
+
+	for _, ia := range msg.Message.IANAs() {
+		idx, lease, found := pool.findBinding(duid, ia.IAID)
+
+		if !found {
+			out := IANA{IAID: ia.IAID}
+			out.Options.AddStatus(DHCPv6NoBinding, "No binding for IA")
+			reply.Options.Add(IANAv6OptionCode, out.Encode())
+			continue
+		}
+
+		messageLog6(pool.Logger, msg).Info("Lease released", "address", lease.Address)
+		pool.dropLease(idx)
+	}
+
+	for _, ia := range msg.Message.IAPDs() {
+		if pool.Delegation == nil || !pool.Delegation.release(duid, ia.IAID) {
+			out := IAPD{IAID: ia.IAID}
+			out.Options.AddStatus(DHCPv6NoBinding, "No binding for IA")
+			reply.Options.Add(IAPDv6OptionCode, out.Encode())
+		}
+	}
+
+	reply.Options.AddStatus(DHCPv6Success, "Released")
+
+	pool.send(msg, reply, sender)
+}
+
+func (pool *Pool6) handleDecline(msg *DirectedDHCPv6Message, serverDUID []byte, sender chan<- DirectedDHCPv6Message) {
+	reply := BuildBasicReplyv6(&msg.Message, DHCPv6Reply, serverDUID)
+	duid := msg.Message.ClientDUID()
+
+	for _, ia := range msg.Message.IANAs() {
+		idx, lease, found := pool.findBinding(duid, ia.IAID)
+
+		if !found {
+			out := IANA{IAID: ia.IAID}
+			out.Options.AddStatus(DHCPv6NoBinding, "No binding for IA")
+			reply.Options.Add(IANAv6OptionCode, out.Encode())
+			continue
+		}
+
+		for _, addr := range ia.Addresses() {
+			if !addr.Address.Equal(lease.Address) {
+				continue
+			}
+
+			messageLog6(pool.Logger, msg).Warn("Address conflict reported, quarantining", "address", lease.Address, "quarantine", pool.Quarantine)
+
+			pool.putLease(idx, &Lease{
+				Address: lease.Address,
+				State:   LeaseDeclined,
+				Expires: time.Now().Add(pool.Quarantine),
+			})
+		}
+	}
+
+	reply.Options.AddStatus(DHCPv6Success, "Declined")
+
+	pool.send(msg, reply, sender)
+}
+
+// bind returns client's binding for IA, allocating new one when needed
+func (pool *Pool6) bind(duid []byte, iaid uint32, state LeaseState) (*Lease, bool) {
+	if pool.Network.IP == nil {
+		return nil, false
+	}
+
+	idx, lease, found := pool.findBinding(duid, iaid)
+
+	if !found {
+		free := pool.freeIndices()
+
+		if len(free) == 0 {
+			pool.Logger.Warn("No addresses free")
+			return nil, false
+		}
+
+		idx = selectNumber(pool.Algorithm, free, hashIndex(iaKey(duid, iaid), pool.Start, pool.End))
+		lease = &Lease{
+			Address: pool.addressFromIndex(idx),
+			ID: ClientIdentifier{
+				ID: duid,
+			},
+			IAID: iaid,
+		}
+
+		pool.Logger.Info("Lease reserved", "address", lease.Address, "iaid", iaid)
+	}
+
+	// advertised address must not downgrade committed binding
+	if lease.State != LeaseInUse {
+		lease.State = state
+	}
+
+	if state == LeaseInUse {
+		lease.Expires = time.Now().Add(pool.Lifetime)
+	} else if lease.State == LeaseReserved {
+		lease.Expires = time.Now().Add(advertiseHoldTime)
+	}
+
+	pool.putLease(idx, lease)
+
+	return lease, true
+}
+
+// delegatePrefixes answers IA_PD options with client's prefixes
+func (pool *Pool6) delegatePrefixes(request *DHCPv6Message, reply *DHCPv6Message, state LeaseState) {
+	for _, ia := range request.IAPDs() {
+		out := IAPD{IAID: ia.IAID}
+
+		var lease *Lease
+		ok := false
+
+		if pool.Delegation != nil {
+			lease, ok = pool.Delegation.bind(request.ClientDUID(), ia.IAID, state)
+		}
+
+		if ok {
+			pool.Delegation.addLeaseToIA(&out, lease)
+		} else {
+			out.Options.AddStatus(DHCPv6NoPrefixAvail, "No prefixes available")
+		}
+
+		reply.Options.Add(IAPDv6OptionCode, out.Encode())
+	}
+}
+
+// renewPrefixes extends IA_PD bindings, prefixes not delegated to client get zero lifetimes
+func (pool *Pool6) renewPrefixes(request *DHCPv6Message, reply *DHCPv6Message) {
+	for _, ia := range request.IAPDs() {
+		out := IAPD{IAID: ia.IAID}
+
+		var lease *Lease
+		found := false
+
+		if pool.Delegation != nil {
+			lease, found = pool.Delegation.renew(request.ClientDUID(), ia.IAID)
+		}
+
+		if found {
+			pool.Delegation.addLeaseToIA(&out, lease)
+		}
+
+		invalid := false
+
+		for _, prefix := range ia.Prefixes() {
+			if found && prefix.Prefix.IP.Equal(lease.Address) {
+				continue
+			}
+
+			invalid = true
+			zero := IAPrefix{Prefix: prefix.Prefix}
+			out.Options.Add(IAPrefixv6OptionCode, zero.Encode())
+		}
+
+		if !found && !invalid {
+			out.Options.AddStatus(DHCPv6NoBinding, "No binding for IA")
+		}
+
+		reply.Options.Add(IAPDv6OptionCode, out.Encode())
+	}
+}
+
+func (pool *Pool6) addLeaseToIA(ia *IANA, lease *Lease) {
+	// RFC 8415 21.4 recommended values
+	ia.T1 = pool.Preferred / 2
+	ia.T2 = pool.Preferred * 4 / 5
+
+	addr := IAAddress{
+		Address:   lease.Address,
+		Preferred: pool.Preferred,
+		Valid:     pool.Lifetime,
+	}
+
+	ia.Options.Add(IAAddressv6OptionCode, addr.Encode())
+}
+
+func (pool *Pool6) findBinding(duid []byte, iaid uint32) (uint32, *Lease, bool) {
+	for idx, lease := range pool.Leases {
+		if lease.State != LeaseDeclined && lease.IAID == iaid && bytes.Equal(lease.ID.ID, duid) {
+			return idx, lease, true
+		}
+	}
+
+	return 0, nil, false
+}
+
+// iaKey identifies identity association of client, for Hashed algorithm
+func iaKey(duid []byte, iaid uint32) []byte {
+	return binary.BigEndian.AppendUint32(append([]byte(nil), duid...), iaid)
+}
+
+func (pool *Pool6) freeIndices() []uint32 {
+	result := make([]uint32, 0)
+
+	for i := pool.Start; i <= pool.End; i++ {
+		if _, exists := pool.Leases[i]; !exists {
+			result = append(result, i)
+		}
+	}
+
+	return result
+}
+
+func (pool *Pool6) addressFromIndex(index uint32) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, pool.Network.IP.To16())
+
+	binary.BigEndian.PutUint32(ip[12:], binary.BigEndian.Uint32(ip[12:])|index)
+
+	return ip
+}
+
+func (pool *Pool6) indexFromAddress(ip net.IP) (uint32, error) {
+	ip16 := ip.To16()
+
+	if ip16 == nil || ip.To4() != nil {
+		return 0, errors.New("Invalid IPv6 address")
+	}
+
+	if !pool.Network.Contains(ip16) {
+		return 0, errors.New("Address outside of pool network")
+	}
+
+	network := pool.Network.IP.To16()
+
+	if !bytes.Equal(ip16[:12], network[:12]) {
+		return 0, errors.New("Address outside of pool range")
+	}
+
+	return binary.BigEndian.Uint32(ip16[12:]) &^ binary.BigEndian.Uint32(network[12:]), nil
+}
+
+// configuredOptions adds configured options client asked for
+func (pool *Pool6) configuredOptions(reply *DHCPv6Message, request *DHCPv6Message) {
+	requested := request.RequestedOptions()
+
+	for _, opt := range pool.Options {
+		wanted := requested == nil
+
+		for _, code := range requested {
+			if code == opt.Code {
+				wanted = true
+			}
+		}
+
+		if wanted {
+			reply.Options.Add(opt.Code, opt.Data)
+		}
+	}
+}
+
+func (pool *Pool6) send(msg *DirectedDHCPv6Message, reply DHCPv6Message, sender chan<- DirectedDHCPv6Message) {
+	pool.configuredOptions(&reply, &msg.Message)
+
+	messageLog6(pool.Logger, msg).Debug("Sending DHCPv6 reply", "reply", reply.Type.String())
+	DumpDHCPv6Message(pool.Logger, "Sending", &reply)
+
+	sender <- DirectedDHCPv6Message{
+		Message:   reply,
+		Interface: msg.Interface,
+		Remote:    msg.Remote,
+	}
+}
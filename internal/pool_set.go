@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"net"
+	"sync"
+)
+
+// PoolSet routes incoming messages to pools. It may be swapped on reload
+// while admin and metrics handlers read it, hence the lock.
+type PoolSet struct {
+	mutex       sync.RWMutex
+	pools       []*Pool
+	byInterface map[int][]*Pool
+}
+
+func NewPoolSet() *PoolSet {
+	return &PoolSet{
+		pools:       make([]*Pool, 0),
+		byInterface: make(map[int][]*Pool),
+	}
+}
+
+func (set *PoolSet) Add(pool *Pool, interfaces []*net.Interface) {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	set.pools = append(set.pools, pool)
+
+	for _, iface := range interfaces {
+		set.byInterface[iface.Index] = append(set.byInterface[iface.Index], pool)
+	}
+}
+
+// Pools returns copy of pool list
+func (set *PoolSet) Pools() []*Pool {
+	set.mutex.RLock()
+	defer set.mutex.RUnlock()
+
+	return append([]*Pool(nil), set.pools...)
+}
+
+// Find returns pool with given name
+func (set *PoolSet) Find(name string) *Pool {
+	set.mutex.RLock()
+	defer set.mutex.RUnlock()
+
+	for _, pool := range set.pools {
+		if pool.Name == name {
+			return pool
+		}
+	}
+
+	return nil
+}
+
+// Replace takes over pools and routing of other set
+func (set *PoolSet) Replace(other *PoolSet) {
+	other.mutex.RLock()
+	defer other.mutex.RUnlock()
+
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	set.pools = other.pools
+	set.byInterface = other.byInterface
+}
+
+// Select picks pool by relay agent address for relayed messages,
+// by ingress interface otherwise. Among those, pools restricted to
+// relay agent circuit or remote ids win over unrestricted ones.
+func (set *PoolSet) Select(msg *DirectedDHCPMessage) (*Pool, bool) {
+	set.mutex.RLock()
+	defer set.mutex.RUnlock()
+
+	var candidates []*Pool
+
+	if msg.Message.Relayed() {
+		for _, pool := range set.pools {
+			if pool.Network.Contains(msg.Message.RelayAgentIP) {
+				candidates = append(candidates, pool)
+			}
+		}
+	} else {
+		candidates = set.byInterface[msg.Interface.Index]
+	}
+
+	var fallback *Pool
+
+	for _, pool := range candidates {
+		if pool.Agents.Empty() {
+			if fallback == nil {
+				fallback = pool
+			}
+		} else if pool.Agents.Matches(&msg.Message) {
+			return pool, true
+		}
+	}
+
+	return fallback, fallback != nil
+}
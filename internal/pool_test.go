@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReserveRejectsUnusableAddresses(t *testing.T) {
+	tests := []struct {
+		name    string
+		network string
+		address string
+		err     string
+	}{
+		{"network address", "10.0.0.0/24", "10.0.0.0", "network address"},
+		{"broadcast address", "10.0.0.0/24", "10.0.0.255", "broadcast address"},
+		{"server address", "127.0.0.0/8", "127.0.0.1", "belongs to server"},
+		{"outside network", "10.0.0.0/24", "10.0.1.5", "outside of pool network"},
+		{"point to point", "10.0.0.0/31", "10.0.0.0", ""},
+		{"usable", "10.0.0.0/24", "10.0.0.50", ""},
+	}
+
+	for _, test := range tests {
+		pool := newTestPool(t, PoolConfig{Network: test.network, Start: 0, End: 1, Lifetime: "1h"})
+		lease := &Lease{Address: net.ParseIP(test.address), State: LeaseStatic, ID: testClient(1)}
+
+		err := pool.reserve(lease)
+
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			}
+			continue
+		}
+
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error %v, expected %q", test.name, err, test.err)
+		}
+
+		if len(pool.Leases) != 0 {
+			t.Errorf("%s: rejected reservation stored", test.name)
+		}
+	}
+}
+
+// removalStore records removed addresses
+type removalStore struct {
+	MemoryLeaseStore
+	removed []string
+}
+
+func (store *removalStore) Remove(address net.IP) error {
+	store.removed = append(store.removed, address.String())
+	return nil
+}
+
+func TestReconfigureDropsLeaseOfNewHost(t *testing.T) {
+	store := &removalStore{}
+	conf := PoolConfig{Network: "10.0.0.0/24", Start: 10, End: 20, Lifetime: "1h"}
+
+	pool, err := NewPool("test", &conf, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expires := time.Now().Add(time.Hour)
+	other, printer := testClient(1), testClient(2)
+
+	for _, lease := range []*Lease{
+		{Address: net.IPv4(10, 0, 0, 12), ID: other, State: LeaseInUse, Expires: expires},
+		{Address: net.IPv4(10, 0, 0, 13), ID: printer, State: LeaseInUse, Expires: expires},
+		{Address: net.IPv4(10, 0, 0, 14), State: LeaseDeclined, Expires: expires},
+	} {
+		idx, _ := pool.leaseIndex(lease)
+		pool.setLease(idx, lease)
+	}
+
+	conf.Hosts = map[string]HostConfig{
+		"taken":    {Mac: "08:00:27:ff:ff:ff", Address: "10.0.0.12"},
+		"printer":  {Mac: printer.Mac.String(), Address: "10.0.0.13"},
+		"declined": {Mac: "08:00:27:ff:ff:fe", Address: "10.0.0.14"},
+	}
+
+	if err := pool.Reconfigure(&conf); err != nil {
+		t.Fatal(err)
+	}
+
+	checkAllocator(t, pool)
+
+	if _, found := pool.Leases[12]; found || len(store.removed) != 1 || store.removed[0] != "10.0.0.12" {
+		t.Errorf("Lease of other client not dropped, removed %v", store.removed)
+	}
+
+	if _, found := pool.Leases[13]; !found {
+		t.Error("Lease of host's client dropped")
+	}
+
+	if _, found := pool.Leases[14]; !found {
+		t.Error("Quarantine of declined address dropped")
+	}
+}
@@ -0,0 +1,266 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"time"
+)
+
+// delegation block holds at most 2^maxDelegationBits prefixes
+const maxDelegationBits = 16
+
+// PrefixPool delegates fixed length prefixes carved out of larger block.
+// Indices are sequence numbers of prefixes within the block, Last being
+// the highest one.
+type PrefixPool struct {
+	Leases    LeaseMap
+	Store     LeaseStore
+	Network   net.IPNet
+	Length    int
+	Last      uint32
+	Lifetime  time.Duration
+	Preferred time.Duration
+	Algorithm AddressSelectAlgorithm
+	Logger    *slog.Logger
+}
+
+func NewPrefixPool(name string, conf *DelegationConfig, store LeaseStore) (*PrefixPool, error) {
+	n, err := parseDelegationBlock(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	blockLength, _ := n.Mask.Size()
+
+	lifetime, err := time.ParseDuration(conf.Lifetime)
+	if err != nil {
+		return nil, fmt.Errorf("lifetime: %v", err)
+	}
+
+	preferred := lifetime
+	if conf.Preferred != "" {
+		if preferred, err = time.ParseDuration(conf.Preferred); err != nil {
+			return nil, fmt.Errorf("preferred: %v", err)
+		}
+	}
+
+	pool := &PrefixPool{
+		Leases:    make(LeaseMap),
+		Store:     store,
+		Network:   *n,
+		Length:    conf.Length,
+		Last:      uint32((uint64(1) << uint(conf.Length-blockLength)) - 1),
+		Lifetime:  lifetime,
+		Preferred: preferred,
+		Algorithm: parseAlgorithm(conf.Algorithm),
+		Logger:    Log.With("pool", name, "delegation", true),
+	}
+
+	pool.restoreLeases()
+
+	return pool, nil
+}
+
+// parseDelegationBlock checks delegated prefix length fits the block
+func parseDelegationBlock(conf *DelegationConfig) (*net.IPNet, error) {
+	_, n, err := net.ParseCIDR(conf.Network)
+	if err != nil {
+		return nil, err
+	}
+
+	blockLength, bits := n.Mask.Size()
+
+	if bits != 128 || n.IP.To4() != nil {
+		return nil, errors.New("Delegation network must be IPv6")
+	}
+
+	if conf.Length <= blockLength || conf.Length > 128 {
+		return nil, fmt.Errorf("Invalid delegated prefix length %d for /%d block", conf.Length, blockLength)
+	}
+
+	// free prefixes are searched linearly
+	if conf.Length-blockLength > maxDelegationBits {
+		return nil, fmt.Errorf("Block /%d holds more than %d prefixes of length %d", blockLength, 1<<maxDelegationBits, conf.Length)
+	}
+
+	return n, nil
+}
+
+func (pool *PrefixPool) restoreLeases() {
+	for _, lease := range pool.Store.Leases() {
+		idx, err := pool.indexFromPrefix(lease.Address)
+
+		if err != nil {
+			pool.Logger.Warn("Dropping stored prefix outside of delegation block", "prefix", lease.Address)
+			pool.Store.Remove(lease.Address)
+			continue
+		}
+
+		pool.Leases[idx] = lease
+	}
+
+	pool.Logger.Info("Restored delegated prefixes", "count", len(pool.Leases))
+}
+
+func (pool *PrefixPool) putLease(idx uint32, lease *Lease) {
+	pool.Leases[idx] = lease
+
+	if err := pool.Store.Put(lease); err != nil {
+		pool.Logger.Error("Unable to store delegated prefix", "prefix", lease.Address, "error", err)
+	}
+}
+
+func (pool *PrefixPool) dropLease(idx uint32) {
+	lease := pool.Leases[idx]
+	delete(pool.Leases, idx)
+
+	if err := pool.Store.Remove(lease.Address); err != nil {
+		pool.Logger.Error("Unable to remove stored delegated prefix", "prefix", lease.Address, "error", err)
+	}
+}
+
+func (pool *PrefixPool) expireOld() {
+	for i, lease := range pool.Leases {
+		if lease.Expires.Before(time.Now()) {
+			pool.dropLease(i)
+			pool.Logger.Info("Delegated prefix expired", "prefix", lease.Address)
+		}
+	}
+
+	if err := pool.Store.Compact(pool.Leases); err != nil {
+		pool.Logger.Error("Unable to compact delegated prefix store", "error", err)
+	}
+}
+
+// bind returns client's delegated prefix for IA, allocating new one when needed
+func (pool *PrefixPool) bind(duid []byte, iaid uint32, state LeaseState) (*Lease, bool) {
+	idx, lease, found := pool.findBinding(duid, iaid)
+
+	if !found {
+		free := pool.freeIndices()
+
+		if len(free) == 0 {
+			pool.Logger.Warn("No prefixes free for delegation")
+			return nil, false
+		}
+
+		idx = selectNumber(pool.Algorithm, free, hashIndex(iaKey(duid, iaid), 0, pool.Last))
+		lease = &Lease{
+			Address: pool.prefixFromIndex(idx),
+			ID: ClientIdentifier{
+				ID: duid,
+			},
+			IAID: iaid,
+		}
+
+		pool.Logger.Info("Prefix reserved", "prefix", lease.Address, "iaid", iaid)
+	}
+
+	if lease.State != LeaseInUse {
+		lease.State = state
+	}
+
+	if state == LeaseInUse {
+		lease.Expires = time.Now().Add(pool.Lifetime)
+	} else if lease.State == LeaseReserved {
+		lease.Expires = time.Now().Add(advertiseHoldTime)
+	}
+
+	pool.putLease(idx, lease)
+
+	return lease, true
+}
+
+// renew extends binding of IA, returns false when there's none
+func (pool *PrefixPool) renew(duid []byte, iaid uint32) (*Lease, bool) {
+	idx, lease, found := pool.findBinding(duid, iaid)
+
+	if !found {
+		return nil, false
+	}
+
+	lease.State = LeaseInUse
+	lease.Expires = time.Now().Add(pool.Lifetime)
+	pool.putLease(idx, lease)
+
+	return lease, true
+}
+
+func (pool *PrefixPool) release(duid []byte, iaid uint32) bool {
+	idx, lease, found := pool.findBinding(duid, iaid)
+
+	if !found {
+		return false
+	}
+
+	pool.Logger.Info("Delegated prefix released", "prefix", lease.Address)
+	pool.dropLease(idx)
+
+	return true
+}
+
+func (pool *PrefixPool) addLeaseToIA(ia *IAPD, lease *Lease) {
+	ia.T1 = pool.Preferred / 2
+	ia.T2 = pool.Preferred * 4 / 5
+
+	prefix := IAPrefix{
+		Preferred: pool.Preferred,
+		Valid:     pool.Lifetime,
+		Prefix: net.IPNet{
+			IP:   lease.Address,
+			Mask: net.CIDRMask(pool.Length, 128),
+		},
+	}
+
+	ia.Options.Add(IAPrefixv6OptionCode, prefix.Encode())
+}
+
+func (pool *PrefixPool) findBinding(duid []byte, iaid uint32) (uint32, *Lease, bool) {
+	for idx, lease := range pool.Leases {
+		if lease.IAID == iaid && bytes.Equal(lease.ID.ID, duid) {
+			return idx, lease, true
+		}
+	}
+
+	return 0, nil, false
+}
+
+func (pool *PrefixPool) freeIndices() []uint32 {
+	result := make([]uint32, 0)
+
+	for i := uint64(0); i <= uint64(pool.Last); i++ {
+		if _, exists := pool.Leases[uint32(i)]; !exists {
+			result = append(result, uint32(i))
+		}
+	}
+
+	return result
+}
+
+func (pool *PrefixPool) prefixFromIndex(index uint32) net.IP {
+	base := new(big.Int).SetBytes(pool.Network.IP.To16())
+	offset := new(big.Int).Lsh(big.NewInt(int64(index)), uint(128-pool.Length))
+
+	ip := make(net.IP, net.IPv6len)
+	sum := new(big.Int).Add(base, offset).Bytes()
+	copy(ip[net.IPv6len-len(sum):], sum)
+
+	return ip
+}
+
+func (pool *PrefixPool) indexFromPrefix(ip net.IP) (uint32, error) {
+	ip16 := ip.To16()
+
+	if ip16 == nil || !pool.Network.Contains(ip16) {
+		return 0, errors.New("Prefix outside of delegation block")
+	}
+
+	base := new(big.Int).SetBytes(pool.Network.IP.To16())
+	offset := new(big.Int).Sub(new(big.Int).SetBytes(ip16), base)
+
+	return uint32(new(big.Int).Rsh(offset, uint(128-pool.Length)).Uint64()), nil
+}
@@ -0,0 +1,193 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+)
+
+type ProbeMethod int
+
+const (
+	ProbeNone ProbeMethod = iota
+	// ICMP echo request, works across relays
+	ProbeICMP ProbeMethod = iota
+	// ARP request on ingress interface, directly connected clients only
+	ProbeARP ProbeMethod = iota
+)
+
+const (
+	ethPArp         = 0x0806
+	arpOpRequest    = 1
+	arpOpReply      = 2
+	icmpEchoReply   = 0
+	icmpEchoRequest = 8
+	// addresses probed for single DISCOVER before giving up
+	maxProbeAttempts = 3
+)
+
+func parseProbeMethod(name string) ProbeMethod {
+	switch name {
+	case "icmp":
+		return ProbeICMP
+	case "arp":
+		return ProbeARP
+	}
+
+	return ProbeNone
+}
+
+// probeAddress reports whether some host answers on ip within timeout
+func probeAddress(method ProbeMethod, iface *net.Interface, ip net.IP, timeout time.Duration) (bool, error) {
+	switch method {
+	case ProbeICMP:
+		return pingProbe(ip, timeout)
+	case ProbeARP:
+		return arpProbe(iface, ip, timeout)
+	}
+
+	return false, nil
+}
+
+func pingProbe(ip net.IP, timeout time.Duration) (bool, error) {
+	conn, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return false, err
+	}
+
+	defer conn.Close()
+
+	id := uint16(rand.Intn(0x10000))
+
+	request := []byte{icmpEchoRequest, 0, 0, 0, byte(id >> 8), byte(id), 0, 1, 'g', 'o', 'd', 'h', 'c', 'p', 'd'}
+	binary.BigEndian.PutUint16(request[2:], icmpChecksum(request))
+
+	if _, err := conn.WriteTo(request, &net.IPAddr{IP: ip}); err != nil {
+		return false, err
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return false, err
+	}
+
+	buffer := make([]byte, 1500)
+
+	for {
+		// IPv4 header is stripped by net package
+		n, addr, err := conn.ReadFrom(buffer)
+
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return false, nil
+			}
+
+			return false, err
+		}
+
+		if n >= 8 && buffer[0] == icmpEchoReply && binary.BigEndian.Uint16(buffer[4:]) == id &&
+			addr.(*net.IPAddr).IP.Equal(ip) {
+			return true, nil
+		}
+	}
+}
+
+func icmpChecksum(data []byte) uint16 {
+	var sum uint32
+
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+
+	for sum > 0xFFFF {
+		sum = sum>>16 + sum&0xFFFF
+	}
+
+	return ^uint16(sum)
+}
+
+// arpProbe sends RFC 5227 ARP probe, zero sender address keeps
+// neighbour caches of other hosts untouched
+func arpProbe(iface *net.Interface, ip net.IP, timeout time.Duration) (bool, error) {
+	ip4 := ip.To4()
+
+	if ip4 == nil {
+		return false, errors.New("Invalid IPv4 address")
+	}
+
+	if iface == nil || len(iface.HardwareAddr) != 6 {
+		return false, errors.New("Only Ethernet interfaces are supported")
+	}
+
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM, int(htons(ethPArp)))
+	if err != nil {
+		return false, err
+	}
+
+	defer syscall.Close(fd)
+
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: htons(ethPArp), Ifindex: iface.Index}); err != nil {
+		return false, err
+	}
+
+	request := make([]byte, 28)
+	binary.BigEndian.PutUint16(request[0:], arpHwEthernet)
+	binary.BigEndian.PutUint16(request[2:], syscall.ETH_P_IP)
+	request[4] = 6
+	request[5] = 4
+	binary.BigEndian.PutUint16(request[6:], arpOpRequest)
+	copy(request[8:], iface.HardwareAddr)
+	copy(request[24:], ip4)
+
+	broadcast := &syscall.SockaddrLinklayer{
+		Protocol: htons(ethPArp),
+		Ifindex:  iface.Index,
+		Halen:    6,
+		Addr:     [8]byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF},
+	}
+
+	if err := syscall.Sendto(fd, request, 0, broadcast); err != nil {
+		return false, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	buffer := make([]byte, 1500)
+
+	for {
+		remaining := time.Until(deadline)
+
+		if remaining <= 0 {
+			return false, nil
+		}
+
+		tv := syscall.NsecToTimeval(remaining.Nanoseconds())
+
+		if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+			return false, err
+		}
+
+		n, _, err := syscall.Recvfrom(fd, buffer, 0)
+
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			return false, fmt.Errorf("ARP probe: %v", err)
+		}
+
+		if n >= 28 && binary.BigEndian.Uint16(buffer[6:]) == arpOpReply && bytes.Equal(buffer[14:18], ip4) {
+			return true, nil
+		}
+	}
+}
+
+func htons(value uint16) uint16 {
+	return value<<8 | value>>8
+}
@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"bytes"
+	"strings"
+)
+
+type RelayAgentSubOptionCode uint8
+
+const (
+	AgentCircuitIDSubOption RelayAgentSubOptionCode = 1
+	AgentRemoteIDSubOption  RelayAgentSubOptionCode = 2
+)
+
+type RelayAgentSubOption struct {
+	Code RelayAgentSubOptionCode
+	Data []byte
+}
+
+// RelayAgentInfoDHCPOption is RFC 3046 relay agent information
+type RelayAgentInfoDHCPOption struct {
+	Value []RelayAgentSubOption
+}
+
+func (opt *RelayAgentInfoDHCPOption) Encode() []byte {
+	var buffer bytes.Buffer
+
+	for _, sub := range opt.Value {
+		buffer.WriteByte(byte(sub.Code))
+		buffer.WriteByte(byte(len(sub.Data)))
+		buffer.Write(sub.Data)
+	}
+
+	return buffer.Bytes()
+}
+
+func (opt *RelayAgentInfoDHCPOption) Decode(data []byte) bool {
+	opt.Value = make([]RelayAgentSubOption, 0, 2)
+
+	for i := 0; i < len(data); {
+		if i+1 >= len(data) {
+			return false
+		}
+
+		code := RelayAgentSubOptionCode(data[i])
+		length := int(data[i+1])
+
+		if length > len(data)-i-2 {
+			return false
+		}
+
+		sub := RelayAgentSubOption{
+			Code: code,
+			Data: make([]byte, length),
+		}
+		copy(sub.Data, data[i+2:i+2+length])
+
+		opt.Value = append(opt.Value, sub)
+		i += 2 + length
+	}
+
+	return true
+}
+
+func (opt *RelayAgentInfoDHCPOption) Data() interface{} {
+	return opt.Value
+}
+
+func (opt *RelayAgentInfoDHCPOption) SubOption(code RelayAgentSubOptionCode) []byte {
+	for _, sub := range opt.Value {
+		if sub.Code == code {
+			return sub.Data
+		}
+	}
+
+	return nil
+}
+
+func (opt *RelayAgentInfoDHCPOption) CircuitID() []byte {
+	return opt.SubOption(AgentCircuitIDSubOption)
+}
+
+func (opt *RelayAgentInfoDHCPOption) RemoteID() []byte {
+	return opt.SubOption(AgentRemoteIDSubOption)
+}
+
+// matchAgentID compares sub-option value with configured one,
+// given either as plain string or as hex prefixed with 0x
+func matchAgentID(pattern string, data []byte) bool {
+	if data == nil {
+		return false
+	}
+
+	if strings.HasPrefix(pattern, "0x") {
+		expected, err := parseHexBytes(pattern[2:])
+
+		return err == nil && bytes.Equal(expected, data)
+	}
+
+	return pattern == string(data)
+}
+
+// AgentIDMatcher restricts pool or host to clients behind given relay agent circuits or remotes
+type AgentIDMatcher struct {
+	CircuitIDs []string
+	RemoteIDs  []string
+}
+
+func (matcher *AgentIDMatcher) Empty() bool {
+	return len(matcher.CircuitIDs) == 0 && len(matcher.RemoteIDs) == 0
+}
+
+// Matches requires every non-empty list to contain respective sub-option value,
+// unrelayed messages match empty matcher only
+func (matcher *AgentIDMatcher) Matches(msg *DHCPMessage) bool {
+	info := msg.RelayAgentInfo()
+
+	if info == nil {
+		return matcher.Empty()
+	}
+
+	if len(matcher.CircuitIDs) > 0 && !matchAnyAgentID(matcher.CircuitIDs, info.CircuitID()) {
+		return false
+	}
+
+	if len(matcher.RemoteIDs) > 0 && !matchAnyAgentID(matcher.RemoteIDs, info.RemoteID()) {
+		return false
+	}
+
+	return true
+}
+
+func matchAnyAgentID(patterns []string, data []byte) bool {
+	for _, pattern := range patterns {
+		if matchAgentID(pattern, data) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"net"
+	"testing"
+)
+
+// newAgentMessage returns request with option 82 carrying circuit id, relayed when giaddr is given
+func newAgentMessage(giaddr net.IP, circuitID string) *DHCPMessage {
+	msg := &DHCPMessage{Options: make(DHCPOptions)}
+	msg.BootpOperation = BootRequest
+	msg.ClientHwAddr = net.HardwareAddr{0x08, 0x00, 0x27, 0x00, 0x00, 0x01}
+	msg.RelayAgentIP = giaddr
+
+	msg.Options[RelayAgentInformationOptionCode] = &RelayAgentInfoDHCPOption{
+		Value: []RelayAgentSubOption{{Code: AgentCircuitIDSubOption, Data: []byte(circuitID)}},
+	}
+
+	return msg
+}
+
+func TestRelayAgentInfoSpoofed(t *testing.T) {
+	matcher := AgentIDMatcher{CircuitIDs: []string{"port-1"}}
+	host := &StaticHost{Name: "camera", Agents: matcher}
+
+	tests := []struct {
+		name    string
+		giaddr  net.IP
+		trusted bool
+	}{
+		{"relayed", net.IPv4(10, 0, 0, 1), true},
+		{"unrelayed", net.IPv4zero, false},
+		{"no giaddr", nil, false},
+	}
+
+	for _, test := range tests {
+		msg := newAgentMessage(test.giaddr, "port-1")
+
+		if matches := matcher.Matches(msg); matches != test.trusted {
+			t.Errorf("%s: pool matcher matches %v, expected %v", test.name, matches, test.trusted)
+		}
+
+		if matches := host.matches(msg); matches != test.trusted {
+			t.Errorf("%s: host matches %v, expected %v", test.name, matches, test.trusted)
+		}
+
+		unrestricted := AgentIDMatcher{}
+
+		if !unrestricted.Matches(msg) {
+			t.Errorf("%s: unrestricted matcher doesn't match", test.name)
+		}
+
+		reply := BuildBasicReply(msg, net.IPv4(10, 0, 0, 2))
+
+		if _, echoed := reply.Options[RelayAgentInformationOptionCode]; echoed != test.trusted {
+			t.Errorf("%s: option 82 echoed %v, expected %v", test.name, echoed, test.trusted)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package internal
+
+import "sort"
+
+// sent regardless of what client asked for, never dropped
+var mandatoryReplyOptions = []DHCPOptionCode{
+	DHCPMessageTypeOptionCode,
+	ServerIdentifierOptionCode,
+	IPAddressLeaseTimeOptionCode,
+	RenewalTimeValueOptionCode,
+	RebindingTimeValueOptionCode,
+	MessageOptionCode,
+}
+
+// priority of options for clients without parameter request list,
+// anything not listed follows ordered by code
+var defaultReplyOptions = []DHCPOptionCode{
+	SubnetMaskOptionCode,
+	RouterOptionCode,
+	DomainNameServerOptionCode,
+	HostNameOptionCode,
+	DomainNameOptionCode,
+}
+
+// selectReplyOptions trims reply options to those requested by client,
+// ordered by request and fitting into client's maximum message size
+func selectReplyOptions(request *DHCPMessage, reply *DHCPMessage) {
+	mandatory := make(map[DHCPOptionCode]bool, len(mandatoryReplyOptions))
+	order := make([]DHCPOptionCode, 0, len(reply.Options))
+
+	// relay agent information must be the last option and is never dropped
+	mandatory[RelayAgentInformationOptionCode] = true
+
+	for _, code := range mandatoryReplyOptions {
+		mandatory[code] = true
+
+		if _, found := reply.Options[code]; found {
+			order = append(order, code)
+		}
+	}
+
+	requested := request.ParameterRequestList()
+
+	if requested == nil {
+		requested = defaultReplyOptions
+		requested = append(requested[:len(requested):len(requested)], sortedCodes(reply.Options)...)
+	}
+
+	listed := make(map[DHCPOptionCode]bool, len(requested))
+
+	for _, code := range requested {
+		if _, found := reply.Options[code]; found && !mandatory[code] && !listed[code] {
+			order = append(order, code)
+		}
+
+		listed[code] = true
+	}
+
+	for code := range reply.Options {
+		if !mandatory[code] && !listed[code] {
+			delete(reply.Options, code)
+		}
+	}
+
+	// drop least wanted options until reply fits
+	size := ipUDPHeaderSize + bootpHeaderSize + 4 + 1
+
+	for _, opt := range reply.Options {
+		size += 2 + len(opt.Encode())
+	}
+
+	for i := len(order) - 1; i >= 0 && size > request.MaxMessageSize(); i-- {
+		code := order[i]
+
+		if mandatory[code] {
+			continue
+		}
+
+		size -= 2 + len(reply.Options[code].Encode())
+		delete(reply.Options, code)
+		order = append(order[:i], order[i+1:]...)
+	}
+
+	if _, found := reply.Options[RelayAgentInformationOptionCode]; found {
+		order = append(order, RelayAgentInformationOptionCode)
+	}
+
+	reply.OptionOrder = order
+}
+
+func sortedCodes(options DHCPOptions) []DHCPOptionCode {
+	codes := make([]DHCPOptionCode, 0, len(options))
+
+	for code := range options {
+		codes = append(codes, code)
+	}
+
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+
+	return codes
+}
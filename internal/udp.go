@@ -1,14 +1,73 @@
 package internal
 
 import (
-	"fmt"
 	"net"
 )
 
+const (
+	DHCPServerPort = 67
+	DHCPClientPort = 68
+)
+
 type DirectedDHCPMessage struct {
 	Message   DHCPMessage
 	Interface *net.Interface
 	Remote    *net.UDPAddr
+	// Destination of reply, broadcast when nil
+	Destination *net.UDPAddr
+	// HwAddr of destination, when set it is put into ARP table before sending
+	HwAddr net.HardwareAddr
+	// Unicast is set for requests addressed to server rather than broadcast
+	Unicast bool
+}
+
+func isZeroIP(ip net.IP) bool {
+	return ip == nil || ip.Equal(net.IPv4zero)
+}
+
+// directReply addresses reply to request according to RFC 2131 4.1
+func directReply(request *DirectedDHCPMessage, reply DHCPMessage) DirectedDHCPMessage {
+	out := DirectedDHCPMessage{
+		Message:   reply,
+		Interface: request.Interface,
+		Remote:    request.Remote,
+	}
+
+	nak := reply.Type() == DHCPNak
+
+	switch {
+	case request.Message.Relayed():
+		// relay agent broadcasts NAK on client's subnet
+		if nak {
+			out.Message.Flags |= BootpBroadcast
+		}
+
+		out.Destination = &net.UDPAddr{
+			IP:   request.Message.RelayAgentIP,
+			Port: DHCPServerPort,
+		}
+
+	case nak:
+		// client may have no usable address, broadcast
+
+	case !isZeroIP(request.Message.ClientIP):
+		out.Destination = &net.UDPAddr{
+			IP:   request.Message.ClientIP,
+			Port: DHCPClientPort,
+		}
+
+	case request.Message.Flags&BootpBroadcast != 0:
+		// client can't receive unicast before it's configured
+
+	case !isZeroIP(reply.YourIP):
+		out.Destination = &net.UDPAddr{
+			IP:   reply.YourIP,
+			Port: DHCPClientPort,
+		}
+		out.HwAddr = reply.ClientHwAddr
+	}
+
+	return out
 }
 
 func UDPReceiver(sock *net.UDPConn) <-chan DirectedDHCPMessage {
@@ -21,7 +80,7 @@ func UDPReceiver(sock *net.UDPConn) <-chan DirectedDHCPMessage {
 			_, _, addr, pktInfo, err := ReadUDPWithPktInfo(sock, buffer)
 
 			if err != nil {
-				fmt.Println("Error while reading UDP message:", err)
+				Log.Error("Error while reading UDP message", "error", err)
 				break
 			}
 
@@ -29,13 +88,18 @@ func UDPReceiver(sock *net.UDPConn) <-chan DirectedDHCPMessage {
 			dhcp, err := UnmarshallDHCPMessage(buffer)
 
 			if err != nil {
-				fmt.Println("Unable to parse DHCP message:", err)
+				Log.Warn("Unable to parse DHCP message", "interface", interfaceName(iface), "remote", addr, "error", err)
+				parseErrors.Inc(interfaceName(iface))
+				continue
 			}
 
+			messagesReceived.Inc(dhcp.Type().String(), interfaceName(iface))
+
 			channel <- DirectedDHCPMessage{
 				Interface: iface,
 				Message:   dhcp,
 				Remote:    addr,
+				Unicast:   !net.IP(pktInfo.Addr[:]).Equal(net.IPv4bcast),
 			}
 		}
 
@@ -49,22 +113,43 @@ func UDPSender(sock *net.UDPConn) chan<- DirectedDHCPMessage {
 	channel := make(chan DirectedDHCPMessage, 10)
 
 	go func() {
-		sendAddr, _ := net.ResolveUDPAddr("udp4", "255.255.255.255:68")
+		broadcastAddr, _ := net.ResolveUDPAddr("udp4", "255.255.255.255:68")
 
 		for msg := range channel {
+			sendAddr := broadcastAddr
+			if msg.Destination != nil {
+				sendAddr = msg.Destination
+			}
+
+			if msg.HwAddr != nil {
+				if err := AddARPEntry(msg.Interface.Name, sendAddr.IP, msg.HwAddr); err != nil {
+					Log.Warn("Unable to add ARP entry, broadcasting instead", "interface", msg.Interface.Name, "address", sendAddr.IP, "error", err)
+					sendAddr = broadcastAddr
+				}
+			}
+
 			bytes, err := MarshallDHCPMessage(msg.Message)
 
 			if err != nil {
-				fmt.Println("Unable to create DHCP message:", err)
+				Log.Error("Unable to create DHCP message", "error", err)
 				continue
 			}
 
-			_, err = WriteUDPWithInterface(sock, bytes, sendAddr, int32(msg.Interface.Index))
+			iface := int32(msg.Interface.Index)
+
+			// relay agent may sit behind a router, let routing table pick the way
+			if msg.Message.Relayed() {
+				iface = 0
+			}
+
+			_, err = WriteUDPWithInterface(sock, bytes, sendAddr, iface)
 
 			if err != nil {
-				fmt.Println("Unable to send DHCP message:", err)
+				Log.Error("Unable to send DHCP message", "interface", msg.Interface.Name, "destination", sendAddr, "error", err)
 				continue
 			}
+
+			messagesSent.Inc(msg.Message.Type().String(), msg.Interface.Name)
 		}
 	}()
 
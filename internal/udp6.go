@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"net"
+)
+
+const (
+	DHCPv6ClientPort = 546
+	DHCPv6ServerPort = 547
+)
+
+// all DHCP relay agents and servers link-scoped multicast address
+var AllDHCPRelayAgentsAndServers = net.ParseIP("ff02::1:2")
+
+type DirectedDHCPv6Message struct {
+	Message   DHCPv6Message
+	Interface *net.Interface
+	Remote    *net.UDPAddr
+}
+
+func UDP6Receiver(sock *net.UDPConn) <-chan DirectedDHCPv6Message {
+	channel := make(chan DirectedDHCPv6Message, 10)
+
+	go func() {
+		for {
+			buffer := make([]byte, 1500)
+
+			n, addr, pktInfo, err := ReadUDP6WithPktInfo(sock, buffer)
+
+			if err != nil {
+				Log.Error("Error while reading UDP6 message", "error", err)
+				break
+			}
+
+			iface, err := net.InterfaceByIndex(int(pktInfo.Ifindex))
+
+			if err != nil {
+				Log.Warn("Unable to find interface of DHCPv6 message", "error", err)
+				continue
+			}
+
+			dhcp, err := UnmarshallDHCPv6Message(buffer[:n])
+
+			if err != nil {
+				Log.Warn("Unable to parse DHCPv6 message", "interface", iface.Name, "remote", addr, "error", err)
+				continue
+			}
+
+			channel <- DirectedDHCPv6Message{
+				Interface: iface,
+				Message:   dhcp,
+				Remote:    addr,
+			}
+		}
+
+		close(channel)
+	}()
+
+	return channel
+}
+
+// UDP6Sender replies directly to client's link-local address
+func UDP6Sender(sock *net.UDPConn) chan<- DirectedDHCPv6Message {
+	channel := make(chan DirectedDHCPv6Message, 10)
+
+	go func() {
+		for msg := range channel {
+			addr := &net.UDPAddr{
+				IP:   msg.Remote.IP,
+				Port: msg.Remote.Port,
+				Zone: msg.Interface.Name,
+			}
+
+			if _, err := sock.WriteToUDP(MarshallDHCPv6Message(msg.Message), addr); err != nil {
+				Log.Error("Unable to send DHCPv6 message", "interface", msg.Interface.Name, "destination", addr, "error", err)
+				continue
+			}
+		}
+	}()
+
+	return channel
+}
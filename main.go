@@ -14,33 +14,234 @@ import (
 
 	"os/signal"
 
+	"reflect"
+
+	"sort"
+
 	"eplight.org/godhcpd/internal"
 )
 
-func createPools() ([]internal.Pool, map[int]*internal.Pool) {
-	pools := make([]internal.Pool, len(internal.GlobalConfig.Pools))
-	mapping := make(map[int]*internal.Pool)
+func lookupInterfaces(names []string) ([]*net.Interface, error) {
+	interfaces := make([]*net.Interface, 0, len(names))
+
+	for _, name := range names {
+		iface, err := net.InterfaceByName(name)
+
+		if err != nil {
+			return nil, fmt.Errorf("Interface %s: %v", name, err)
+		}
+
+		interfaces = append(interfaces, iface)
+	}
+
+	return interfaces, nil
+}
+
+// createPools builds pool set from configuration and starts new pools. Pools
+// of current set with the same name are reconfigured instead, keeping leases.
+func createPools(conf *internal.ConfigFile, current *internal.PoolSet, peer *internal.FailoverPeer, sender chan<- internal.DirectedDHCPMessage) (*internal.PoolSet, error) {
+	set := internal.NewPoolSet()
+
+	names := make([]string, 0, len(conf.Pools))
+
+	for name := range conf.Pools {
+		names = append(names, name)
+	}
+
+	// stable order, first matching pool wins in selection
+	sort.Strings(names)
+
+	// validate everything first, failed reload must leave running pools alone
+	interfaces := make(map[string][]*net.Interface)
+
+	for _, name := range names {
+		poolConf := conf.Pools[name]
+
+		if err := internal.ValidatePoolConfig(name, &poolConf); err != nil {
+			return nil, fmt.Errorf("Invalid pool %s: %v", name, err)
+		}
+
+		ifaces, err := lookupInterfaces(poolConf.Interfaces)
 
-	i := 0
+		if err != nil {
+			return nil, fmt.Errorf("Invalid pool %s: %v", name, err)
+		}
 
-	for name, conf := range internal.GlobalConfig.Pools {
-		fmt.Print("Creating pool ", name, ": ")
-		pools[i] = internal.NewPool(&conf)
+		interfaces[name] = ifaces
+	}
 
-		for _, str := range conf.Interfaces {
-			iface, _ := net.InterfaceByName(str)
+	// open stores of new pools before touching existing ones
+	created := make(map[string]*internal.Pool)
 
-			fmt.Print(iface.Name, ", ")
+	for _, name := range names {
+		poolConf := conf.Pools[name]
 
-			mapping[iface.Index] = &pools[i]
+		if current.Find(name) != nil {
+			continue
 		}
 
-		fmt.Print("\n")
+		store, err := internal.NewLeaseStore(&internal.GlobalConfig.Leases, name)
+
+		if err == nil {
+			var pool *internal.Pool
+
+			if peer != nil {
+				store = peer.WrapStore(name, store)
+			}
+
+			if pool, err = internal.NewPool(name, &poolConf, store); err == nil {
+				pool.Peer = peer
+				created[name] = pool
+				continue
+			}
 
-		i++
+			store.Close()
+		}
+
+		// not running yet, only stores need closing
+		for _, pool := range created {
+			pool.Store.Close()
+		}
+
+		return nil, fmt.Errorf("Unable to create pool %s: %v", name, err)
 	}
 
-	return pools, mapping
+	for _, name := range names {
+		poolConf := conf.Pools[name]
+
+		if pool, found := created[name]; found {
+			go pool.Run(sender)
+			set.Add(pool, interfaces[name])
+
+			internal.Log.Info("Pool created", "pool", name, "network", poolConf.Network, "interfaces", poolConf.Interfaces)
+			continue
+		}
+
+		pool := current.Find(name)
+
+		var err error
+
+		pool.Do(func() { err = pool.Reconfigure(&poolConf) })
+
+		if err != nil {
+			internal.Log.Error("Unable to reconfigure pool", "pool", name, "error", err)
+		}
+
+		set.Add(pool, interfaces[name])
+	}
+
+	return set, nil
+}
+
+// reloadConfig re-reads configuration and applies logging and pool changes,
+// the rest requires restart
+func reloadConfig(file string, pools *internal.PoolSet, peer *internal.FailoverPeer, sender chan<- internal.DirectedDHCPMessage) error {
+	conf, err := internal.ReadConfig(file)
+
+	if err != nil {
+		return err
+	}
+
+	if err := internal.SetupLogging(&conf.Log); err != nil {
+		return err
+	}
+
+	set, err := createPools(&conf, pools, peer, sender)
+
+	if err != nil {
+		return err
+	}
+
+	removed := pools.Pools()
+	pools.Replace(set)
+
+	for _, pool := range removed {
+		if set.Find(pool.Name) == nil {
+			pool.Stop()
+			internal.Log.Info("Pool removed", "pool", pool.Name)
+		}
+	}
+
+	old := internal.GlobalConfig
+
+	if !reflect.DeepEqual(old.Leases, conf.Leases) || !reflect.DeepEqual(old.Admin, conf.Admin) ||
+		!reflect.DeepEqual(old.Metrics, conf.Metrics) || !reflect.DeepEqual(old.Failover, conf.Failover) ||
+		!reflect.DeepEqual(old.Pools6, conf.Pools6) {
+		internal.Log.Warn("Changes to leases, admin, metrics, failover and pools6 sections require restart")
+	}
+
+	internal.GlobalConfig.Log = conf.Log
+	internal.GlobalConfig.Pools = conf.Pools
+
+	return nil
+}
+
+func createPools6(sock *net.UDPConn) ([]*internal.Pool6, map[int]*internal.Pool6, error) {
+	pools := make([]*internal.Pool6, 0, len(internal.GlobalConfig.Pools6))
+	mapping := make(map[int]*internal.Pool6)
+
+	for name, conf := range internal.GlobalConfig.Pools6 {
+		store, err := internal.NewLeaseStore(&internal.GlobalConfig.Leases, name+".v6")
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("Unable to open lease store for DHCPv6 pool %s: %v", name, err)
+		}
+
+		var delegation *internal.PrefixPool
+
+		if conf.Delegation.Network != "" {
+			pdStore, err := internal.NewLeaseStore(&internal.GlobalConfig.Leases, name+".pd")
+
+			if err != nil {
+				return nil, nil, fmt.Errorf("Unable to open prefix store for DHCPv6 pool %s: %v", name, err)
+			}
+
+			if delegation, err = internal.NewPrefixPool(name, &conf.Delegation, pdStore); err != nil {
+				return nil, nil, fmt.Errorf("Invalid delegation of DHCPv6 pool %s: %v", name, err)
+			}
+		}
+
+		interfaces, err := lookupInterfaces(conf.Interfaces)
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid DHCPv6 pool %s: %v", name, err)
+		}
+
+		pool, err := internal.NewPool6(name, &conf, store, delegation)
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid DHCPv6 pool %s: %v", name, err)
+		}
+
+		for _, iface := range interfaces {
+			if err := internal.JoinMulticast6(sock, internal.AllDHCPRelayAgentsAndServers, iface); err != nil {
+				return nil, nil, fmt.Errorf("Unable to join DHCPv6 multicast group on %s: %v", iface.Name, err)
+			}
+
+			mapping[iface.Index] = pool
+		}
+
+		internal.Log.Info("DHCPv6 pool created", "pool", name, "network", conf.Network, "interfaces", conf.Interfaces)
+
+		pools = append(pools, pool)
+	}
+
+	return pools, mapping, nil
+}
+
+// reportConfigErrors prints every configuration problem on its own line
+func reportConfigErrors(err error) {
+	errs, ok := err.(internal.ConfigErrors)
+
+	if !ok {
+		errs = internal.ConfigErrors{err}
+	}
+
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Configuration invalid, %d problem(s) found\n", len(errs))
 }
 
 func main() {
@@ -49,6 +250,7 @@ func main() {
 
 	// flags
 	configFileName := flag.String("config", "godhcpd.toml", "Configuration file")
+	checkConfig := flag.Bool("check-config", false, "Validate configuration file and exit")
 	help := flag.Bool("help", false, "Display help")
 	flag.Parse()
 
@@ -58,21 +260,34 @@ func main() {
 	}
 
 	// configuration
-	internal.LoadGlobalConfig(*configFileName)
+	if err := internal.LoadGlobalConfig(*configFileName); err != nil {
+		reportConfigErrors(err)
+		os.Exit(1)
+	}
+
+	if *checkConfig {
+		fmt.Println("Configuration OK")
+		return
+	}
+
+	if err := internal.SetupLogging(&internal.GlobalConfig.Log); err != nil {
+		internal.Log.Error("Cannot set up logging", "error", err)
+		return
+	}
 
 	// we need to bind to all to receive broadcasts
 	addr, _ := net.ResolveUDPAddr("udp4", ":67")
 	sock, err := net.ListenUDP("udp4", addr)
 
 	if err != nil {
-		fmt.Println("Cannot create UDP listening socket", err)
+		internal.Log.Error("Cannot create UDP listening socket", "error", err)
 		return
 	}
 
 	defer sock.Close()
 
 	if err := internal.EnablePktInfo(sock); err != nil {
-		fmt.Println("Cannot enable IP_PKTINFO", err)
+		internal.Log.Error("Cannot enable IP_PKTINFO", "error", err)
 		return
 	}
 
@@ -82,45 +297,157 @@ func main() {
 	defer close(signals)
 	defer close(sender)
 
-	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGHUP)
+
+	var peer *internal.FailoverPeer
+
+	if internal.GlobalConfig.Failover.Role != "" {
+		if peer, err = internal.NewFailoverPeer(&internal.GlobalConfig.Failover); err != nil {
+			internal.Log.Error("Invalid failover configuration", "error", err)
+			return
+		}
+	}
+
+	pools, err := createPools(&internal.GlobalConfig, internal.NewPoolSet(), peer, sender)
+
+	if err != nil {
+		internal.Log.Error("Cannot create pools", "error", err)
+		return
+	}
+
+	// set changes on reload, stop whatever is there at exit
+	defer func() {
+		for _, pool := range pools.Pools() {
+			pool.Stop()
+		}
+	}()
+
+	if peer != nil {
+		go func() {
+			if err := peer.Run(pools); err != nil {
+				internal.Log.Error("Failover stopped", "error", err)
+			}
+		}()
+	}
+
+	if listen := internal.GlobalConfig.Admin.Listen; listen != "" {
+		go func() {
+			internal.Log.Info("Admin API listening", "address", listen)
+
+			if err := internal.ServeAdmin(listen, pools); err != nil {
+				internal.Log.Error("Admin API failed", "error", err)
+			}
+		}()
+	}
 
-	pools, mapping := createPools()
+	if listen := internal.GlobalConfig.Metrics.Listen; listen != "" {
+		go func() {
+			internal.Log.Info("Metrics listening", "address", listen)
 
-	for i := range pools {
-		go pools[i].Run(sender)
-		defer close(pools[i].Receiver)
+			if err := internal.ServeMetrics(listen, pools); err != nil {
+				internal.Log.Error("Metrics endpoint failed", "error", err)
+			}
+		}()
 	}
 
-	fmt.Println("Entering main loop")
+	// DHCPv6 runs on its own socket, only when configured
+	var receiver6 <-chan internal.DirectedDHCPv6Message
+	var mapping6 map[int]*internal.Pool6
+
+	if len(internal.GlobalConfig.Pools6) > 0 {
+		addr6, _ := net.ResolveUDPAddr("udp6", "[::]:547")
+		sock6, err := net.ListenUDP("udp6", addr6)
+
+		if err != nil {
+			internal.Log.Error("Cannot create UDP6 listening socket", "error", err)
+			return
+		}
+
+		defer sock6.Close()
+
+		if err := internal.EnablePktInfo6(sock6); err != nil {
+			internal.Log.Error("Cannot enable IPV6_RECVPKTINFO", "error", err)
+			return
+		}
+
+		var pools6 []*internal.Pool6
+
+		pools6, mapping6, err = createPools6(sock6)
+
+		if err != nil {
+			internal.Log.Error("Cannot create DHCPv6 pools", "error", err)
+			return
+		}
+
+		receiver6 = internal.UDP6Receiver(sock6)
+		sender6 := internal.UDP6Sender(sock6)
+		// deferred calls run in reverse, pools are stopped before sender is closed
+		defer close(sender6)
+
+		for _, pool := range pools6 {
+			go pool.Run(sender6)
+			defer pool.Stop()
+		}
+	}
+
+	internal.Log.Info("Entering main loop")
 
 MainLoop:
 	for {
 		select {
 		case msg, more := <-receiver:
 			if !more {
-				fmt.Println("UDP receiver socket error")
+				internal.Log.Error("UDP receiver socket error")
 				break MainLoop
 			}
 
-			p, found := mapping[msg.Interface.Index]
+			p, found := pools.Select(&msg)
 
 			if !found {
-				fmt.Println("Ignoring packet from interface:", msg.Interface.Name)
+				if msg.Message.Relayed() {
+					internal.Log.Debug("Ignoring packet from unknown relay agent", "giaddr", msg.Message.RelayAgentIP)
+				} else {
+					internal.Log.Debug("Ignoring packet from interface", "interface", msg.Interface.Name)
+				}
 				break
 			}
 
-			fmt.Println(">>>>>")
-			fmt.Println("Received packet from interface:", msg.Interface.Name)
+			internal.DumpDHCPMessage(p.Logger, "Received", &msg.Message)
+
+			p.Receiver <- msg
+
+		case msg, more := <-receiver6:
+			if !more {
+				internal.Log.Error("UDP6 receiver socket error")
+				break MainLoop
+			}
+
+			p, found := mapping6[msg.Interface.Index]
 
-			internal.DebugDHCPMessage(&msg.Message)
+			if !found {
+				internal.Log.Debug("Ignoring DHCPv6 packet from interface", "interface", msg.Interface.Name)
+				break
+			}
+
+			internal.DumpDHCPv6Message(p.Logger, "Received", &msg.Message)
 
 			p.Receiver <- msg
 
 		case sig := <-signals:
-			fmt.Println("Signal received: ", sig)
+			internal.Log.Info("Signal received", "signal", sig)
+
+			if sig == syscall.SIGHUP {
+				if err := reloadConfig(*configFileName, pools, peer, sender); err != nil {
+					internal.Log.Error("Configuration reload failed, keeping previous", "error", err)
+				} else {
+					internal.Log.Info("Configuration reloaded")
+				}
+				break
+			}
+
 			break MainLoop
 		}
 	}
 
-	fmt.Println("Exiting main loop")
+	internal.Log.Info("Exiting main loop")
 }